@@ -2,19 +2,38 @@ package containerutils
 
 import (
 	"errors"
+	"sort"
 )
 
 // ResolveServiceDependencies recursively traces image dependencies
 // and ensures that the required image has been added
 func ResolveServiceDependencies(out *ComposeFile, template *ComposeFile) (bool, error) {
-	serviceAdded := false
 	if template == nil {
 		return false, errors.New("No services found in the template input")
 	}
 	if out == nil {
 		return false, errors.New("No services to resolve")
 	}
+	return resolveDependencies(out, template, template.dependsOn, nil)
+}
 
+// dependsOn returns the depends_on entries of the given service
+func (cf *ComposeFile) dependsOn(service string) []string {
+	svc, ok := cf.Services[service]
+	if !ok || svc == nil {
+		return nil
+	}
+	deps := make([]string, len(svc.DependsOn))
+	for i, dep := range svc.DependsOn {
+		deps[i] = dep.String()
+	}
+	return deps
+}
+
+// resolveDependencies adds the transitive closure of the dependencies of the
+// services in out, taking them from template. The explain callback, when
+// given, is told which service required each added service
+func resolveDependencies(out *ComposeFile, template *ComposeFile, deps func(service string) []string, explain func(service, requiredBy string)) (bool, error) {
 	getServiceFromCompose := func(file ComposeFile, service string) (*Service, error) {
 		s, ok := file.Services[service]
 		if !ok {
@@ -23,28 +42,30 @@ func ResolveServiceDependencies(out *ComposeFile, template *ComposeFile) (bool,
 		return s, nil
 	}
 
+	queue := make([]string, 0, len(out.Services))
 	for k := range out.Services {
-		dependsOn := template.Services[k].DependsOn
-		if dependsOn == nil {
-			continue
-		}
+		queue = append(queue, k)
+	}
+	sort.Strings(queue)
 
-		for _, dependentService := range dependsOn {
-			if _, ok := out.Services[dependentService.String()]; ok {
+	serviceAdded := false
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		for _, dependentService := range deps(k) {
+			if _, ok := out.Services[dependentService]; ok {
 				continue
 			}
-			service, err := getServiceFromCompose(*template, dependentService.String())
-			if err != nil || service == nil {
+			service, err := getServiceFromCompose(*template, dependentService)
+			if err != nil {
 				return false, err
 			}
-			out.Services[dependentService.String()] = service
+			out.Services[dependentService] = service
 			serviceAdded = true
-			for serviceAdded == true {
-				serviceAdded, err = ResolveServiceDependencies(out, template)
-				if err != nil {
-					return false, err
-				}
+			if explain != nil {
+				explain(dependentService, k)
 			}
+			queue = append(queue, dependentService)
 		}
 	}
 	return serviceAdded, nil
@@ -0,0 +1,100 @@
+package containerutils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BlacklistStrategy decides what happens to the services that depend on a
+// blacklisted service
+type BlacklistStrategy int
+
+const (
+	// BlacklistStrip removes the dependencies on blacklisted services from
+	// their dependents, which is what DeleteBlacklisted does
+	BlacklistStrip BlacklistStrategy = iota
+	// BlacklistCascade also deletes every service that directly or
+	// transitively depends on a blacklisted service
+	BlacklistCascade
+	// BlacklistRefuse leaves the compose file untouched and returns an
+	// error when any remaining service depends on a blacklisted service
+	BlacklistRefuse
+)
+
+// StrippedDependency is a depends_on entry that was removed from a service
+type StrippedDependency struct {
+	Service    string
+	Dependency string
+}
+
+// BlacklistReport lists the services that were affected by a blacklist
+type BlacklistReport struct {
+	// Removed are the blacklisted services that were present
+	Removed []string
+	// Cascaded are the dependents that were deleted along with them
+	Cascaded []string
+	// Stripped are the dependencies that were removed from the services
+	// that remain
+	Stripped []StrippedDependency
+}
+
+// DeleteBlacklistedWith deletes the blacklisted services from the ComposeFile
+// and handles the services that depend on them according to the strategy
+func (cf *ComposeFile) DeleteBlacklistedWith(blacklist []string, strategy BlacklistStrategy) (BlacklistReport, error) {
+	report := BlacklistReport{}
+	removed := make(map[string]bool)
+	for _, svc := range blacklist {
+		if cf.HasService(svc) && !removed[svc] {
+			removed[svc] = true
+			report.Removed = append(report.Removed, svc)
+		}
+	}
+	sort.Strings(report.Removed)
+
+	switch strategy {
+	case BlacklistRefuse:
+		var broken []string
+		for _, name := range cf.serviceNames() {
+			if removed[name] {
+				continue
+			}
+			for _, dep := range cf.Services[name].DependsOn {
+				if removed[dep.String()] {
+					broken = append(broken, fmt.Sprintf("%v depends on %v", name, dep))
+				}
+			}
+		}
+		if len(broken) > 0 {
+			return BlacklistReport{}, fmt.Errorf("Could not delete blacklisted services: %v", strings.Join(broken, ", "))
+		}
+	case BlacklistCascade:
+		queue := append([]string(nil), report.Removed...)
+		for len(queue) > 0 {
+			svc := queue[0]
+			queue = queue[1:]
+			for _, dependent := range cf.dependentsOf(svc) {
+				if removed[dependent] {
+					continue
+				}
+				removed[dependent] = true
+				report.Cascaded = append(report.Cascaded, dependent)
+				queue = append(queue, dependent)
+			}
+		}
+		sort.Strings(report.Cascaded)
+	}
+
+	for name := range removed {
+		delete(cf.Services, name)
+	}
+	for _, name := range cf.serviceNames() {
+		for _, dep := range cf.Services[name].DependsOn {
+			if removed[dep.String()] {
+				report.Stripped = append(report.Stripped, StrippedDependency{Service: name, Dependency: dep.String()})
+			}
+		}
+	}
+	cf.EnsureDependencies()
+	return report, nil
+}
@@ -0,0 +1,236 @@
+package containerutils
+
+//go:generate go run ./cmd/clonegen -type Service -output clone_service.go
+
+// Clone returns a deep copy of the registry, which shares no slices, maps or
+// pointers with the original
+func (rf *RegistryFile) Clone() RegistryFile {
+	_rf := RegistryFile{
+		Services:          rf.Services.Clone(),
+		DeposedServices:   cloneStrings(rf.DeposedServices),
+		UnmanagedServices: cloneStrings(rf.UnmanagedServices),
+		DefaultGroups:     cloneStrings(rf.DefaultGroups),
+	}
+	if rf.Modes != nil {
+		_rf.Modes = make([]Mode, len(rf.Modes))
+		for i, m := range rf.Modes {
+			_rf.Modes[i] = m.clone()
+		}
+	}
+	if rf.Secrets != nil {
+		_rf.Secrets = make(map[string]SecretDefinition, len(rf.Secrets))
+		for k, v := range rf.Secrets {
+			_rf.Secrets[k] = v
+		}
+	}
+	if rf.Networks != nil {
+		_rf.Networks = make(map[string]NetworkDefinition, len(rf.Networks))
+		for k, v := range rf.Networks {
+			_rf.Networks[k] = v
+		}
+	}
+	if rf.Overrides != nil {
+		_rf.Overrides = make(map[string]RegistryOverlay, len(rf.Overrides))
+		for k, v := range rf.Overrides {
+			_rf.Overrides[k] = v.clone()
+		}
+	}
+	return _rf
+}
+
+// Clone returns a deep copy of the services
+func (s Services) Clone() Services {
+	if s == nil {
+		return nil
+	}
+	_s := make(Services, len(s))
+	copy(_s, s)
+	for i := range _s {
+		_s[i].cloneFields()
+	}
+	return _s
+}
+
+// Clone returns a deep copy of the compose file
+func (cf *ComposeFile) Clone() ComposeFile {
+	_cf := ComposeFile{Version: cf.Version, Name: cf.Name}
+	if cf.Services != nil {
+		_cf.Services = make(map[string]*Service, len(cf.Services))
+		for name, svc := range cf.Services {
+			_cf.Services[name] = svc.Clone()
+		}
+	}
+	_cf.Secrets = cloneMapOfMaps(cf.Secrets)
+	_cf.Networks = cloneMapOfMaps(cf.Networks)
+	return _cf
+}
+
+func (m Mode) clone() Mode {
+	_m := m
+	_m.Include = cloneStrings(m.Include)
+	_m.Exclude = cloneStrings(m.Exclude)
+	_m.ExposePorts = cloneStrings(m.ExposePorts)
+	_m.Environment = cloneMap(m.Environment)
+	_m.ServiceEnvironment = cloneMapOfMaps(m.ServiceEnvironment)
+	_m.Transformers = cloneStrings(m.Transformers)
+	_m.Local = cloneStrings(m.Local)
+	return _m
+}
+
+func (ro RegistryOverlay) clone() RegistryOverlay {
+	if ro.Services == nil {
+		return ro
+	}
+	_ro := RegistryOverlay{Services: make(map[string]ServiceOverride, len(ro.Services))}
+	for name, o := range ro.Services {
+		if o.DefaultTag != nil {
+			v := *o.DefaultTag
+			o.DefaultTag = &v
+		}
+		if o.Replicas != nil {
+			v := *o.Replicas
+			o.Replicas = &v
+		}
+		if o.Restart != nil {
+			v := *o.Restart
+			o.Restart = &v
+		}
+		o.Port = cloneInts(o.Port)
+		o.Environment = cloneMap(o.Environment)
+		o.Deploy = cloneMap(o.Deploy)
+		_ro.Services[name] = o
+	}
+	return _ro
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func cloneInts(s []int) []int {
+	if s == nil {
+		return nil
+	}
+	return append([]int{}, s...)
+}
+
+func cloneAttributeSlice(a []Attribute) []Attribute {
+	if a == nil {
+		return nil
+	}
+	return append([]Attribute{}, a...)
+}
+
+func cloneAttributes(a Attributes) Attributes {
+	if a == nil {
+		return nil
+	}
+	return append(Attributes{}, a...)
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	_m := make(map[string]string, len(m))
+	for k, v := range m {
+		_m[k] = v
+	}
+	return _m
+}
+
+func cloneServiceLogs(l []ServiceLogs) []ServiceLogs {
+	if l == nil {
+		return nil
+	}
+	return append([]ServiceLogs{}, l...)
+}
+
+func clonePGConnectionManager(m *ServicePGConnectionManager) *ServicePGConnectionManager {
+	if m == nil {
+		return nil
+	}
+	_m := *m
+	return &_m
+}
+
+func cloneServiceNetworks(sn ServiceNetworks) ServiceNetworks {
+	if sn == nil {
+		return nil
+	}
+	_sn := make(ServiceNetworks, len(sn))
+	for i, n := range sn {
+		n.Aliases = cloneStrings(n.Aliases)
+		_sn[i] = n
+	}
+	return _sn
+}
+
+func cloneServiceSecrets(ss ServiceSecrets) ServiceSecrets {
+	if ss == nil {
+		return nil
+	}
+	return append(ServiceSecrets{}, ss...)
+}
+
+func cloneScheduledTasks(st []ScheduledTask) []ScheduledTask {
+	if st == nil {
+		return nil
+	}
+	return append([]ScheduledTask{}, st...)
+}
+
+func cloneMapOfMaps(m map[string]map[string]interface{}) map[string]map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	_m := make(map[string]map[string]interface{}, len(m))
+	for k, v := range m {
+		_m[k] = cloneMap(v)
+	}
+	return _m
+}
+
+func cloneMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	_m := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		_m[k] = cloneValue(v)
+	}
+	return _m
+}
+
+// cloneValue copies the maps and slices that json and yaml decode into
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return cloneMap(v)
+	case map[interface{}]interface{}:
+		_m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			_m[k] = cloneValue(e)
+		}
+		return _m
+	case []interface{}:
+		_v := make([]interface{}, len(v))
+		for i, e := range v {
+			_v[i] = cloneValue(e)
+		}
+		return _v
+	case []string:
+		return cloneStrings(v)
+	case []map[string]interface{}:
+		_v := make([]map[string]interface{}, len(v))
+		for i, e := range v {
+			_v[i] = cloneMap(e)
+		}
+		return _v
+	default:
+		return v
+	}
+}
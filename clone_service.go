@@ -0,0 +1,50 @@
+// Code generated by clonegen; DO NOT EDIT.
+
+package containerutils
+
+// Clone returns a deep copy of the service, which shares no slices, maps
+// or pointers with the original
+func (s *Service) Clone() *Service {
+	_s := *s
+	_s.cloneFields()
+	return &_s
+}
+
+// cloneFields replaces the slices, maps and pointers of the service with
+// copies, so that a shallow copy no longer shares them with its original
+func (s *Service) cloneFields() {
+	s.Port = cloneInts(s.Port)
+	s.DockerComposePort = cloneAttributes(s.DockerComposePort)
+	s.Schedule = cloneScheduledTasks(s.Schedule)
+	s.PGConnectionManager = clonePGConnectionManager(s.PGConnectionManager)
+	s.Dependencies = cloneStrings(s.Dependencies)
+	s.Groups = cloneStrings(s.Groups)
+	s.DependsOn = cloneAttributes(s.DependsOn)
+	s.DependsOnCondition = cloneStringMap(s.DependsOnCondition)
+	s.Logs = cloneServiceLogs(s.Logs)
+	s.Volumes = cloneAttributeSlice(s.Volumes)
+	s.Environment = cloneMap(s.Environment)
+	s.Deploy = cloneMap(s.Deploy)
+	s.CapAdd = cloneAttributes(s.CapAdd)
+	s.CapDrop = cloneAttributes(s.CapDrop)
+	s.Configs = cloneAttributes(s.Configs)
+	s.DNS = cloneAttributes(s.DNS)
+	s.DNSOpt = cloneAttributes(s.DNSOpt)
+	s.DNSSearch = cloneAttributes(s.DNSSearch)
+	s.EnvFile = cloneAttributes(s.EnvFile)
+	s.Expose = cloneAttributes(s.Expose)
+	s.Extends = cloneMap(s.Extends)
+	s.ExternalLinks = cloneAttributes(s.ExternalLinks)
+	s.ExtraHosts = cloneAttributes(s.ExtraHosts)
+	s.GroupAdd = cloneAttributes(s.GroupAdd)
+	s.Healthcheck = cloneMap(s.Healthcheck)
+	s.Labels = cloneStringMap(s.Labels)
+	s.Links = cloneAttributes(s.Links)
+	s.Logging = cloneMap(s.Logging)
+	s.Networks = cloneServiceNetworks(s.Networks)
+	s.Profiles = cloneAttributes(s.Profiles)
+	s.Secrets = cloneServiceSecrets(s.Secrets)
+	s.SecurityOpt = cloneAttributes(s.SecurityOpt)
+	s.Sysctls = cloneAttributes(s.Sysctls)
+	s.ULimits = cloneMap(s.ULimits)
+}
@@ -0,0 +1,263 @@
+package containerutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testRegistry returns a registry that exercises everything generation
+// touches: generated ports, the router port, waiting for postgres,
+// dependencies on deposed services, services that are excluded from the
+// service registry, secrets, networks, groups and jobs. Every call returns a
+// fresh copy, so that one can serve as the snapshot of another
+func testRegistry() RegistryFile {
+	return RegistryFile{
+		Services: Services{
+			{Name: "router", Container: "router", Port: []int{80}, Port80InDocker: true, DependsOn: Attributes{"auth", "legacy"}, Environment: map[string]interface{}{"AUTH_URL": "http://auth:2003/login"}},
+			{Name: "db", Container: "db", Image: "postgres:13", Port: []int{5432}, IsExternalImage: true, Environment: map[string]interface{}{"POSTGRES_PASSWORD": "secret"}},
+			{
+				Name:         "auth",
+				Container:    "auth",
+				Port:         []int{2003, 2004},
+				Dependencies: []string{"db", "migrate"},
+				DependsOn:    Attributes{"db", "legacy", "migrate"},
+				Environment:  map[string]interface{}{"DB_HOST": "db:5432"},
+				Labels:       map[string]string{"team": "platform"},
+				Secrets:      ServiceSecrets{{Source: "auth_key"}},
+				Networks:     ServiceNetworks{{Name: "backend", Aliases: []string{"login"}}},
+				Groups:       []string{"core"},
+				Logs:         []ServiceLogs{{Name: "auth", Filename: "auth.log", Parser: "json"}},
+			},
+			{Name: "migrate", Container: "migrate", Job: true, DependsOn: Attributes{"db"}},
+			{Name: "reports", Container: "reports", Port: []int{2010}, Groups: []string{"reporting"}, DependsOn: Attributes{"dbpool"}, ExcludeFromServiceRegistry: true},
+			{Name: "legacy", Container: "legacy", Port: []int{2020}},
+			{Name: "docs", URL: "/docs"},
+		},
+		DeposedServices: []string{"legacy"},
+		Modes: []Mode{{
+			Name:               "staging",
+			ExposePorts:        []string{"router"},
+			Environment:        map[string]interface{}{"STAGE": "staging"},
+			ServiceEnvironment: map[string]map[string]interface{}{"auth": {"DB_HOST": "dbpool:5432"}},
+		}},
+		Secrets:  map[string]SecretDefinition{"auth_key": {File: "./auth.key"}},
+		Networks: map[string]NetworkDefinition{"backend": {Driver: "bridge"}},
+	}
+}
+
+func marshalCompose(t *testing.T, cf ComposeFile) []byte {
+	t.Helper()
+	b, err := yaml.Marshal(cf)
+	if err != nil {
+		t.Fatalf("Could not marshal compose file: %v", err)
+	}
+	return b
+}
+
+func TestConstructIsRepeatable(t *testing.T) {
+	defer func(rf RegistryFile) { _file = rf }(_file)
+	_file = testRegistry()
+	snapshot := testRegistry()
+
+	// Every image of the production compose file is locked, so that it can
+	// be pinned
+	production, err := ConstructProductionCompose("v1.4", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := ImageLock{Images: make(map[string]string)}
+	for _, ref := range production.Images() {
+		lock.Images[normalizeImageRef(ref)] = "sha256:0123456789abcdef"
+	}
+	lockFile := filepath.Join(t.TempDir(), "image-lock.json")
+	if err := lock.Write(lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	whitelist, profiles := []string{"auth"}, []string{"reporting"}
+	constructors := map[string]func() (ComposeFile, error){
+		"developer":    ConstructDeveloperCompose,
+		"orchestrator": func() (ComposeFile, error) { return ConstructOrchestratorCompose(8080) },
+		"production":   func() (ComposeFile, error) { return ConstructProductionCompose("v1.4", 8080) },
+		"whitelist": func() (ComposeFile, error) {
+			cf, _, err := ConstructCompose(DeveloperMode, ComposeServiceConfig{WhiteList: &whitelist, Profiles: &profiles})
+			return cf, err
+		},
+		"profile": func() (ComposeFile, error) { return ConstructProfileCompose(DeveloperMode, "core") },
+		"mode":    func() (ComposeFile, error) { return ConstructModeCompose("staging", "v1.4", 8080) },
+		"pinned":  func() (ComposeFile, error) { return ConstructPinnedProductionCompose("v1.4", 8080, lockFile) },
+		"hybrid": func() (ComposeFile, error) {
+			cf, _, err := ConstructHybridCompose("auth")
+			return cf, err
+		},
+		"debug": func() (ComposeFile, error) { return ConstructDebugOverlay(DebugConfig{Services: []string{"auth"}}) },
+	}
+	for name, construct := range constructors {
+		first, err := construct()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		second, err := construct()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if a, b := marshalCompose(t, first), marshalCompose(t, second); !bytes.Equal(a, b) {
+			t.Errorf("%v: the second call differs from the first:\n%s\n---\n%s", name, a, b)
+		}
+		if !reflect.DeepEqual(_file, snapshot) {
+			t.Fatalf("%v: the registry was changed by generating a compose file", name)
+		}
+	}
+
+	first, err := ConstructServiceRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ConstructServiceRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("the second service registry differs from the first:\n%s\n---\n%s", first, second)
+	}
+	if !reflect.DeepEqual(_file, snapshot) {
+		t.Fatal("the registry was changed by filtering the excluded services")
+	}
+}
+
+func TestGeneratedPortsAndDependencies(t *testing.T) {
+	rf := testRegistry()
+	cf, err := rf.ToDockerCompose("", DeveloperMode, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cf.Services["auth"].DockerComposePort, (Attributes{"127.0.0.1:2003:2003", "127.0.0.1:2004:2004"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("auth ports = %v, want %v", got, want)
+	}
+	if got, want := cf.Services["router"].DockerComposePort, (Attributes{"127.0.0.1:80:80"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("router ports = %v, want %v", got, want)
+	}
+	if cf.Services["router"].DependsOn.Contains("legacy") || cf.Services["auth"].DependsOn.Contains("legacy") {
+		t.Error("the dependencies on the deposed service were kept")
+	}
+	if rf.Services[0].DockerComposePort != nil || !rf.Services[0].DependsOn.Contains("legacy") {
+		t.Error("the ports or dependencies of the registry were changed")
+	}
+}
+
+func TestFilterExcludedServices(t *testing.T) {
+	rf := testRegistry()
+	filtered := rf.filterExcludedServices()
+	if len(filtered.Services) != len(rf.Services)-1 {
+		t.Fatalf("got %v services, want %v", len(filtered.Services), len(rf.Services)-1)
+	}
+	for _, svc := range filtered.Services {
+		if svc.ExcludeFromServiceRegistry {
+			t.Errorf("'%v' is excluded from the service registry, but was kept", svc.Name)
+		}
+	}
+	filtered.Services[0].Port[0] = 1
+	if rf.Services[0].Port[0] != 80 {
+		t.Error("the filtered registry shares its ports with the registry")
+	}
+}
+
+func TestServicesAppend(t *testing.T) {
+	var ss Services
+	ss.Append(Service{Name: "a"})
+	ss.Append(Service{Name: "b"})
+	if len(ss) != 2 || ss[0].Name != "a" || ss[1].Name != "b" {
+		t.Errorf("Append gave %v", ss)
+	}
+}
+
+func TestRegistryFileCloneIsDeep(t *testing.T) {
+	rf := testRegistry()
+	_rf := rf.Clone()
+	if !reflect.DeepEqual(rf, _rf) {
+		t.Fatal("the clone differs from the registry")
+	}
+
+	svc := &_rf.Services[2]
+	svc.Port[0] = 1
+	svc.Dependencies[0] = "changed"
+	svc.DependsOn[0] = "changed"
+	svc.Environment["DB_HOST"] = "changed"
+	svc.Labels["team"] = "changed"
+	svc.Secrets[0].Source = "changed"
+	svc.Networks[0].Aliases[0] = "changed"
+	svc.Groups[0] = "changed"
+	svc.Logs[0].Parser = "changed"
+	_rf.DeposedServices[0] = "changed"
+	_rf.Secrets["auth_key"] = SecretDefinition{File: "changed"}
+	_rf.Networks["backend"] = NetworkDefinition{Driver: "changed"}
+
+	if !reflect.DeepEqual(rf, testRegistry()) {
+		t.Error("changing the clone changed the registry")
+	}
+}
+
+// benchmarkRegistry returns a registry of n services that depend on the db
+// and on each other, along the lines of a large install
+func benchmarkRegistry(n int) RegistryFile {
+	rf := RegistryFile{Services: make(Services, 0, n+2)}
+	rf.Services = append(rf.Services,
+		Service{Name: "router", Container: "router", Port: []int{80}, Port80InDocker: true},
+		Service{Name: "db", Container: "db", Image: "postgres:13", Port: []int{5432}, IsExternalImage: true},
+	)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("service%04d", i)
+		svc := Service{
+			Name:        name,
+			Container:   name,
+			Port:        []int{3000 + i},
+			DependsOn:   Attributes{"db"},
+			Environment: map[string]interface{}{"PGHOST": "db", "SERVICE": name},
+			Groups:      []string{fmt.Sprintf("group%v", i%10)},
+		}
+		if i > 0 {
+			svc.Dependencies = []string{fmt.Sprintf("service%04d", i-1)}
+		}
+		rf.Services = append(rf.Services, svc)
+	}
+	return rf
+}
+
+func BenchmarkConstructDeveloperCompose(b *testing.B) {
+	defer func(rf RegistryFile) { _file = rf }(_file)
+	_file = benchmarkRegistry(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ConstructDeveloperCompose(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	rf := benchmarkRegistry(1000)
+	cfg := GenerateConfig{Mode: DeveloperMode}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rf.Generate(context.Background(), cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRegistryFileClone(b *testing.B) {
+	rf := benchmarkRegistry(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rf.Clone()
+	}
+}
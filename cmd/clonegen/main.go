@@ -0,0 +1,142 @@
+// Command clonegen writes a Clone method for a struct of the containerutils
+// package. Every field is copied explicitly, and a field whose type has no
+// known copy expression fails the generation rather than being skipped
+//
+//	go run ./cmd/clonegen -type Service -output clone_service.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// copiers holds the copy expression of every reference type that appears in
+// a cloned struct, keyed by the type as written in the source. Value types
+// are copied along with the struct itself
+var copiers = map[string]string{
+	"[]string":                    "cloneStrings(%v)",
+	"[]int":                       "cloneInts(%v)",
+	"[]Attribute":                 "cloneAttributeSlice(%v)",
+	"Attributes":                  "cloneAttributes(%v)",
+	"map[string]interface{}":      "cloneMap(%v)",
+	"map[string]string":           "cloneStringMap(%v)",
+	"[]ServiceLogs":               "cloneServiceLogs(%v)",
+	"*ServicePGConnectionManager": "clonePGConnectionManager(%v)",
+	"ServiceNetworks":             "cloneServiceNetworks(%v)",
+	"ServiceSecrets":              "cloneServiceSecrets(%v)",
+	"[]ScheduledTask":             "cloneScheduledTasks(%v)",
+}
+
+var valueTypes = map[string]bool{
+	"string": true,
+	"bool":   true,
+	"int":    true,
+}
+
+func main() {
+	typeName := flag.String("type", "", "the struct to generate a Clone method for")
+	output := flag.String("output", "", "the file to write, defaults to clone_<type>.go")
+	flag.Parse()
+	if *typeName == "" {
+		fmt.Fprintln(os.Stderr, "clonegen: -type is required")
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = "clone_" + strings.ToLower(*typeName) + ".go"
+	}
+	if err := generate(".", *typeName, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "clonegen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(dir, typeName, output string) error {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != filepath.Base(output)
+	}, 0)
+	if err != nil {
+		return fmt.Errorf("Could not parse '%v': %v", dir, err)
+	}
+
+	for name, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			st := findStruct(file, typeName)
+			if st == nil {
+				continue
+			}
+			src, err := render(fset, name, typeName, st)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, output), src, 0644)
+		}
+	}
+	return fmt.Errorf("Could not find the struct '%v' in '%v'", typeName, dir)
+}
+
+func findStruct(file *ast.File, typeName string) *ast.StructType {
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if st, ok := ts.Type.(*ast.StructType); ok && ts.Name.Name == typeName {
+				return st
+			}
+		}
+	}
+	return nil
+}
+
+func render(fset *token.FileSet, pkg, typeName string, st *ast.StructType) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by clonegen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %v\n\n", pkg)
+	fmt.Fprintf(&buf, "// Clone returns a deep copy of the %v, which shares no slices, maps\n", strings.ToLower(typeName))
+	fmt.Fprintf(&buf, "// or pointers with the original\n")
+	fmt.Fprintf(&buf, "func (s *%v) Clone() *%v {\n", typeName, typeName)
+	fmt.Fprintf(&buf, "\t_s := *s\n")
+	fmt.Fprintf(&buf, "\t_s.cloneFields()\n")
+	fmt.Fprintf(&buf, "\treturn &_s\n}\n\n")
+	fmt.Fprintf(&buf, "// cloneFields replaces the slices, maps and pointers of the %v with\n", strings.ToLower(typeName))
+	fmt.Fprintf(&buf, "// copies, so that a shallow copy no longer shares them with its original\n")
+	fmt.Fprintf(&buf, "func (s *%v) cloneFields() {\n", typeName)
+	for _, field := range st.Fields.List {
+		var typ bytes.Buffer
+		if err := format.Node(&typ, fset, field.Type); err != nil {
+			return nil, err
+		}
+		if valueTypes[typ.String()] {
+			continue
+		}
+		copier, ok := copiers[typ.String()]
+		if !ok {
+			return nil, fmt.Errorf("Could not clone the fields %v of %v: there is no copier for '%v'", fieldNames(field), typeName, typ.String())
+		}
+		for _, name := range field.Names {
+			fmt.Fprintf(&buf, "\ts.%v = %v\n", name.Name, fmt.Sprintf(copier, "s."+name.Name))
+		}
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return format.Source(buf.Bytes())
+}
+
+func fieldNames(field *ast.Field) string {
+	names := make([]string, len(field.Names))
+	for i, n := range field.Names {
+		names[i] = n.Name
+	}
+	return strings.Join(names, ", ")
+}
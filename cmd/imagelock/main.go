@@ -0,0 +1,80 @@
+// Command imagelock records the digests of the images that a compose file
+// uses in an image lock, which ConstructPinnedProductionCompose pins the
+// images to. The digests are resolved from a local OCI image layout or from
+// a JSON file that maps image references to digests, standing in for a
+// registry, e.g.
+//
+//	go run ./cmd/imagelock -compose docker-compose.yml -oci ./images
+//
+// Images of an OCI layout whose reference annotation only holds a tag are
+// only used with -repo, which names their repository
+//
+// With -check, the lock is left alone and the command fails when an image of
+// the compose file has no entry in it
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jasonkofo/containerutils"
+)
+
+func main() {
+	compose := flag.String("compose", "docker-compose.yml", "the compose file whose images are locked")
+	lock := flag.String("lock", "image-lock.json", "the lock file to update")
+	oci := flag.String("oci", "", "the OCI image layout directory to resolve digests from")
+	repo := flag.String("repo", "", "the repository of the OCI images that are annotated with a tag only")
+	digests := flag.String("digests", "", "a JSON file mapping image references to digests, instead of -oci")
+	check := flag.Bool("check", false, "only check that every image has an entry in the lock")
+	flag.Parse()
+
+	if err := run(*compose, *lock, *oci, *repo, *digests, *check); err != nil {
+		fmt.Fprintf(os.Stderr, "imagelock: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(compose, lock, oci, repo, digests string, check bool) error {
+	cf := containerutils.ComposeFile{}
+	if err := cf.ReadFromFile(compose); err != nil {
+		return err
+	}
+	if check {
+		l, err := containerutils.ReadImageLock(lock)
+		if err != nil {
+			return err
+		}
+		return cf.CheckImageLock(l)
+	}
+
+	resolver, err := digestResolver(oci, repo, digests)
+	if err != nil {
+		return err
+	}
+	return containerutils.UpdateImageLock(lock, &cf, resolver)
+}
+
+// digestResolver returns the resolver that the flags select
+func digestResolver(oci, repo, digests string) (containerutils.DigestResolver, error) {
+	switch {
+	case oci != "" && digests != "":
+		return nil, fmt.Errorf("-oci and -digests cannot be used together")
+	case oci != "":
+		return containerutils.OCILayout{Dir: oci, Repository: repo}, nil
+	case digests != "":
+		file, err := ioutil.ReadFile(digests)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read '%v': %v", digests, err)
+		}
+		sd := containerutils.StaticDigests{}
+		if err = json.Unmarshal(file, &sd); err != nil {
+			return nil, fmt.Errorf("Could not read '%v' into a native json object: %v", digests, err)
+		}
+		return sd, nil
+	}
+	return nil, fmt.Errorf("either -oci or -digests is required")
+}
@@ -0,0 +1,186 @@
+// Command servicegen reads a service-registry.json and writes a Go file with
+// a typed constant for the name of every containerized service, a constant
+// for each of its ports and a lookup table, so that code which refers to a
+// service that has been renamed or removed no longer compiles. It is meant
+// to be run by go generate, e.g.
+//
+//	//go:generate go run github.com/jasonkofo/containerutils/cmd/servicegen -registry service-registry.json -package services
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jasonkofo/containerutils"
+)
+
+// initialisms are written in upper case in identifiers, as golint expects
+var initialisms = map[string]bool{
+	"api":  true,
+	"db":   true,
+	"http": true,
+	"id":   true,
+	"pg":   true,
+	"sql":  true,
+	"ui":   true,
+	"url":  true,
+}
+
+type service struct {
+	ident     string
+	container string
+	name      string
+	ports     []int
+	// portIdents are the names of the port constants, one for each port
+	portIdents []string
+}
+
+func main() {
+	registry := flag.String("registry", "service-registry.json", "the service registry to read")
+	pkg := flag.String("package", "", "the package of the generated file, defaults to $GOPACKAGE")
+	output := flag.String("output", "services_gen.go", "the file to write")
+	flag.Parse()
+	if *pkg == "" {
+		*pkg = os.Getenv("GOPACKAGE")
+	}
+	if *pkg == "" {
+		fmt.Fprintln(os.Stderr, "servicegen: -package is required outside of go generate")
+		os.Exit(2)
+	}
+	if err := generate(*registry, *pkg, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "servicegen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(registry, pkg, output string) error {
+	rf := containerutils.RegistryFile{}
+	if err := rf.ReadFromFile(registry); err != nil {
+		return err
+	}
+	services, err := collect(rf)
+	if err != nil {
+		return err
+	}
+	src, err := render(registry, pkg, services)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, src, 0644)
+}
+
+// collect returns the containerized services that have not been deposed,
+// sorted by container name, failing when two of them map to one identifier.
+// The same goes for the port constants, where e.g. the second port of
+// "router" and the first port of "router2" both become PortRouter2
+func collect(rf containerutils.RegistryFile) ([]service, error) {
+	var services []service
+	idents := make(map[string]string)
+	portIdents := make(map[string]string)
+	for _, svc := range rf.Services {
+		if svc.Container == "" || rf.IsDeposed(svc.Container) || rf.IsDeposed(svc.Name) {
+			continue
+		}
+		ident := identifier(svc.Container)
+		if other, ok := idents[ident]; ok {
+			return nil, fmt.Errorf("Could not generate constants: '%v' and '%v' both become '%v'", other, svc.Container, ident)
+		}
+		idents[ident] = svc.Container
+		s := service{ident: ident, container: svc.Container, name: svc.Name, ports: svc.Port}
+		for i, p := range svc.Port {
+			portIdent := portIdentifier(ident, i)
+			if other, ok := portIdents[portIdent]; ok {
+				return nil, fmt.Errorf("Could not generate constants: %v and port %v of '%v' both become '%v'", other, p, svc.Container, portIdent)
+			}
+			portIdents[portIdent] = fmt.Sprintf("port %v of '%v'", p, svc.Container)
+			s.portIdents = append(s.portIdents, portIdent)
+		}
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].container < services[j].container })
+	return services, nil
+}
+
+// identifier turns a container name such as "imqs-jobservice" or "dbpool"
+// into an exported Go identifier
+func identifier(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var sb strings.Builder
+	for _, w := range words {
+		if initialisms[strings.ToLower(w)] {
+			sb.WriteString(strings.ToUpper(w))
+			continue
+		}
+		sb.WriteString(strings.ToUpper(w[:1]) + w[1:])
+	}
+	ident := sb.String()
+	if ident == "" || unicode.IsDigit(rune(ident[0])) {
+		ident = "N" + ident
+	}
+	return ident
+}
+
+// portIdentifier returns the name of the constant for the i-th port of a
+// service, where the ports after the first are numbered
+func portIdentifier(ident string, i int) string {
+	if i == 0 {
+		return "Port" + ident
+	}
+	return fmt.Sprintf("Port%v%v", ident, i+1)
+}
+
+func render(registry, pkg string, services []service) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by servicegen from %v; DO NOT EDIT.\n\n", filepath.Base(registry))
+	fmt.Fprintf(&buf, "package %v\n\n", pkg)
+
+	buf.WriteString("// ServiceName is the container name of a service in the service registry\n")
+	buf.WriteString("type ServiceName string\n\n")
+	buf.WriteString("// String returns the container name\n")
+	buf.WriteString("func (s ServiceName) String() string {\n\treturn string(s)\n}\n\n")
+
+	buf.WriteString("// The services of the service registry\nconst (\n")
+	for _, s := range services {
+		fmt.Fprintf(&buf, "\tService%v ServiceName = %q\n", s.ident, s.container)
+	}
+	buf.WriteString(")\n\n")
+
+	buf.WriteString("// The ports of the services, where services with several ports get a\n")
+	buf.WriteString("// numbered constant for each port after the first\nconst (\n")
+	for _, s := range services {
+		for i, p := range s.ports {
+			fmt.Fprintf(&buf, "\t%v = %v\n", s.portIdents[i], p)
+		}
+	}
+	buf.WriteString(")\n\n")
+
+	buf.WriteString("// ServiceInfo describes a service of the service registry\n")
+	buf.WriteString("type ServiceInfo struct {\n\tName ServiceName\n\t// RegistryName is the \"name\" of the service in the registry\n\tRegistryName string\n\tPorts []int\n}\n\n")
+	buf.WriteString("// ServiceTable holds every service of the service registry\n")
+	buf.WriteString("var ServiceTable = map[ServiceName]ServiceInfo{\n")
+	for _, s := range services {
+		ports := ""
+		if len(s.ports) > 0 {
+			ports = fmt.Sprintf(", Ports: %#v", s.ports)
+		}
+		fmt.Fprintf(&buf, "\tService%v: {Name: Service%v, RegistryName: %q%v},\n", s.ident, s.ident, s.name, ports)
+	}
+	buf.WriteString("}\n\n")
+
+	buf.WriteString("// LookupService finds a service by its container name or registry name\n")
+	buf.WriteString("func LookupService(name string) (ServiceInfo, bool) {\n")
+	buf.WriteString("\tif info, ok := ServiceTable[ServiceName(name)]; ok {\n\t\treturn info, true\n\t}\n")
+	buf.WriteString("\tfor _, info := range ServiceTable {\n\t\tif info.RegistryName == name {\n\t\t\treturn info, true\n\t\t}\n\t}\n")
+	buf.WriteString("\treturn ServiceInfo{}, false\n}\n")
+	return format.Source(buf.Bytes())
+}
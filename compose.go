@@ -15,113 +15,187 @@ type ComposeTemplateContent struct {
 	VolumeDirectory string
 }
 
-type composeMode int
-
-const (
-	developerCompose    composeMode = 0
-	orchestratorCompose composeMode = 1 << (iota - 1)
-	productionCompose
-)
-
 // ComposeServiceConfig represents JSON data that is posted from clients of this
 // service. Clients are able to specify the services that they would like
-// in their compose files, should they post data correctly.
+// in their compose files, should they post data correctly. WhiteList entries
+// may be glob patterns such as "report*", and Profiles selects the services
+// that belong to any of the given compose profiles.
 type ComposeServiceConfig struct {
 	WhiteList *[]string `json:"whiteList"`
+	Profiles  *[]string `json:"profiles"`
 }
 
 // ComposeFile is a local abstraction of the docker-compose template file
 type ComposeFile struct {
-	Version  string                            `yaml:"version"`
+	// Version is the file format, which is "3.2" for generated files. It is
+	// left out when the file needs the Compose Spec, see MarshalYAML
+	Version string `yaml:"version,omitempty"`
+	// Name is the compose project name, which namespaces the containers,
+	// networks and volumes of the stack
+	Name     string                            `yaml:"name,omitempty"`
 	Services map[string]*Service               `yaml:"services"`
 	Secrets  map[string]map[string]interface{} `yaml:"secrets,omitempty"`
+	Networks map[string]map[string]interface{} `yaml:"networks,omitempty"`
 }
 
-// Write marshals the ComposeFile object into the given filename
-func (cf *ComposeFile) Write(filename string, options map[string]interface{}) error {
-	rp, okRP := options["routerport"]
-	ep, okEP := options["suppressports"]
-	dbp, okDBP := options["dbport"]
-	https, okHTTP := options["https"]
-	suppressPorts := false
-	var (
-		ok       bool
-		isHTTPS  = false
-		dbPort   int
-		dbPort32 int32
-		dbPort64 int64
-	)
-	if okEP {
-		if suppressPorts, ok = ep.(bool); !ok {
-			suppressPorts = false
-		}
+// MarshalYAML leaves the version out when a service waits on a dependency
+// condition, e.g. for a job to complete, or when the file names its project.
+// The long syntax of depends_on and the top-level name are rejected by the
+// "3.x" file formats, so such files follow the Compose Spec instead, which
+// needs Compose v2
+func (cf ComposeFile) MarshalYAML() (interface{}, error) {
+	type plain ComposeFile
+	_cf := plain(cf)
+	if cf.needsComposeSpec() {
+		_cf.Version = ""
 	}
-	if okHTTP {
-		isHTTPS = https.(bool)
+	return _cf, nil
+}
+
+// needsComposeSpec reports whether the file uses features that no versioned
+// file format supports
+func (cf ComposeFile) needsComposeSpec() bool {
+	if cf.Name != "" {
+		return true
 	}
-	if okDBP {
-		dbPort, ok = dbp.(int)
-		if !ok {
-			dbPort32, ok = dbp.(int32)
+	for _, svc := range cf.Services {
+		if svc != nil && svc.hasDependencyConditions() {
+			return true
 		}
-		if ok {
-			dbPort = int(dbPort32)
-		} else {
-			dbPort64, ok = dbp.(int64)
+	}
+	return false
+}
+
+// writeOptions is the parsed form of the options map accepted by
+// ComposeFile.Write and ComposeDocument.Write
+type writeOptions struct {
+	routerPort    interface{}
+	hasRouterPort bool
+	suppressPorts bool
+	https         bool
+	tls           TLSConfig
+	dbPort        int
+}
+
+// parseWriteOptions reads the loosely typed options map into writeOptions.
+// Values of the wrong type fall back to their defaults, and the default
+// "dbport" leaves the ports of the db service as they are
+func parseWriteOptions(options map[string]interface{}) writeOptions {
+	wo := writeOptions{dbPort: defaultDBPort}
+	wo.routerPort, wo.hasRouterPort = options["routerport"]
+	if ep, ok := options["suppressports"]; ok {
+		wo.suppressPorts, _ = ep.(bool)
+	}
+	if https, ok := options["https"]; ok {
+		wo.https, _ = https.(bool)
+	}
+	if dbp, ok := intOption(options["dbport"]); ok {
+		wo.dbPort = dbp
+	}
+	wo.tls = parseTLSOptions(options)
+	return wo
+}
+
+// intOption accepts the integer types that callers commonly put into an
+// options map
+func intOption(v interface{}) (int, bool) {
+	switch p := v.(type) {
+	case int:
+		return p, true
+	case int32:
+		return int(p), true
+	case int64:
+		return int(p), true
+	}
+	return 0, false
+}
+
+// rewritesRouterPorts reports whether the options touch the router ports
+func (wo writeOptions) rewritesRouterPorts() bool {
+	return wo.hasRouterPort || wo.https
+}
+
+// rewriteRouterPort maps a single router port entry onto the configured
+// router port. The second return value is false when the entry should be
+// dropped altogether
+func (wo writeOptions) rewriteRouterPort(port string) (string, bool) {
+	// [JKG 2021-04-13] Inside the docker container, we map the router
+	// to port 80, so any custom configuration will have to map the
+	// external binding on the host to the internal docker port 80
+	if strings.HasSuffix(port, ":80") && wo.hasRouterPort {
+		return fmt.Sprintf("127.0.0.1:%v:80", wo.routerPort), true
+	} else if strings.HasSuffix(port, ":443") {
+		return wo.tls.portMapping(), wo.https
+	}
+	return port, true
+}
+
+// dbPortMapping returns the port entry of the db service when a custom
+// host port has been requested
+func (wo writeOptions) dbPortMapping() string {
+	return fmt.Sprintf("127.0.0.1:%v:%v", wo.dbPort, defaultDBPort)
+}
+
+// Write marshals the ComposeFile object into the given filename.
+// The supported options are:
+//   - "routerport": the host port that the router's port 80 is bound to
+//   - "suppressports": drops the ports of every service except the router
+//   - "dbport": the host port that the db service is bound to
+//   - "https" and the TLS options described by TLSConfig, which publish the
+//     router's port 443 and mount its certificate and key as secrets
+func (cf *ComposeFile) Write(filename string, options map[string]interface{}) error {
+	if err := cf.applyWriteOptions(parseWriteOptions(options), filename); err != nil {
+		return fmt.Errorf("Could not write '%v': %v", filename, err)
+	}
+
+	_cf, err := yaml.Marshal(cf)
+	if err != nil {
+		return fmt.Errorf("Could not write '%v': %v", filename, err.Error())
+	}
+	return ioutil.WriteFile(filename, _cf, 0644)
+}
+
+// applyWriteOptions patches the ports of the router and db services and sets
+// up HTTPS according to the options of Write
+func (cf *ComposeFile) applyWriteOptions(wo writeOptions, filename string) error {
+	if svc, okr := cf.Services[routerService]; okr && wo.rewritesRouterPorts() {
+		attr := make(Attributes, 0, len(svc.DockerComposePort)+1)
+		hasHTTPS := false
+		for _, port := range svc.DockerComposePort {
+			hasHTTPS = hasHTTPS || strings.HasSuffix(string(port), ":443")
+			if p, keep := wo.rewriteRouterPort(string(port)); keep {
+				attr.AndString(p)
+			}
 		}
-		if ok {
-			dbPort = int(dbPort64)
-		} else {
-			dbPort = 5432
+		if wo.https && !hasHTTPS {
+			attr.AndString(wo.tls.portMapping())
 		}
+		svc.DockerComposePort = attr
 	}
-	if okRP {
-		if svc, okr := cf.Services["router"]; okr {
-			// [JKG 2021-04-13] Inside the docker container, we map the router
-			// to port 80, so any custom configuration will have to map the
-			// external binding on the host to the internal docker port 80
-			attr := make(Attributes, 0, len(svc.DockerComposePort))
-			for _, port := range svc.DockerComposePort {
-				if strings.HasSuffix(string(port), ":80") {
-					attr.AndString(
-						fmt.Sprintf("127.0.0.1:%v:80", rp),
-					)
-				} else if strings.HasSuffix(string(port), ":443") {
-					if isHTTPS {
-						attr.AndString(
-							fmt.Sprintf("443:443"),
-						)
-					}
-				} else {
-					attr.AndString(string(port))
-				}
-			}
-			svc.DockerComposePort = attr
+
+	if wo.https {
+		if err := cf.applyTLS(wo.tls, filename); err != nil {
+			return err
 		}
 	}
 
-	if suppressPorts {
+	if wo.suppressPorts {
 		for svcName, svc := range cf.Services {
-			if svcName != "router" {
+			if svcName != routerService {
 				svc.DockerComposePort = nil
 			}
 		}
 	}
 
-	if dbPort != 5432 {
-		dbSvc, ok := cf.Services["db"]
+	if wo.dbPort != defaultDBPort {
+		dbSvc, ok := cf.Services[dbService]
 		if ok {
 			dbSvc.DockerComposePort = Attributes{
-				Attribute(fmt.Sprintf("127.0.0.1:%v:5432", dbPort)),
+				Attribute(wo.dbPortMapping()),
 			}
 		}
 	}
-
-	_cf, err := yaml.Marshal(cf)
-	if err != nil {
-		return fmt.Errorf("Could not write '%v': %v", filename, err.Error())
-	}
-	return ioutil.WriteFile(filename, _cf, 0644)
+	return nil
 }
 
 // ReadFromFile attempts to read the contents of a given file into memory.
@@ -140,19 +214,10 @@ func (cf *ComposeFile) ReadFromFile(filename string) error {
 }
 
 // DeleteBlacklisted deletes services from the ComposeFile object if they
-// are in the given blacklist
+// are in the given blacklist. Dependencies on the deleted services are
+// stripped, see DeleteBlacklistedWith for the other strategies
 func (cf *ComposeFile) DeleteBlacklisted(blacklist []string) {
-	_bl := make(map[string]int)
-	for _, svc := range blacklist {
-		_bl[svc] = 1
-	}
-	for _svcKey := range cf.Services {
-		if _, ok := _bl[_svcKey]; ok {
-			delete(cf.Services, _svcKey)
-		}
-	}
-
-	cf.EnsureDependencies()
+	cf.DeleteBlacklistedWith(blacklist, BlacklistStrip)
 }
 
 // EnsureDependencies removes dependencies that are not present in the
@@ -0,0 +1,502 @@
+package containerutils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeDocument is an editable docker-compose file that is backed by a
+// yaml.Node tree rather than plain structs. Edits made through a
+// ComposeDocument keep the comments, anchors, aliases and key order of a
+// hand-maintained compose file intact
+type ComposeDocument struct {
+	root   *yaml.Node
+	indent int
+}
+
+// ReadComposeDocument reads the given file into a ComposeDocument
+func ReadComposeDocument(filename string) (*ComposeDocument, error) {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read '%v': %v", filename, err)
+	}
+	cd, err := ParseComposeDocument(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read '%v' into a yml document: %v", filename, err)
+	}
+	return cd, nil
+}
+
+// ParseComposeDocument parses the raw contents of a docker-compose file
+func ParseComposeDocument(content []byte) (*ComposeDocument, error) {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(content, root); err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || resolveNode(root.Content[0]).Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("the compose file must be a yml mapping")
+	}
+	return &ComposeDocument{root: root, indent: detectIndent(content)}, nil
+}
+
+// ComposeFile decodes the document into a ComposeFile. The returned object
+// is a copy, so changes made to it are not reflected in the document
+func (cd *ComposeDocument) ComposeFile() (*ComposeFile, error) {
+	cf := &ComposeFile{}
+	if err := cd.root.Decode(cf); err != nil {
+		return nil, fmt.Errorf("Could not decode compose document: %v", err)
+	}
+	return cf, nil
+}
+
+// HasService confirms whether or not the service is found in the document
+func (cd *ComposeDocument) HasService(service string) bool {
+	_, svc := mappingGet(cd.services(), service)
+	return svc != nil
+}
+
+// ServiceNames returns the names of the services in the order that they
+// appear in the document
+func (cd *ComposeDocument) ServiceNames() []string {
+	services := cd.services()
+	if services == nil {
+		return nil
+	}
+	names := make([]string, 0, len(services.Content)/2)
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		names = append(names, services.Content[i].Value)
+	}
+	return names
+}
+
+// DeleteBlacklisted deletes services from the document if they are in the
+// given blacklist. Services that define an anchor which is still aliased by
+// the rest of the document cannot be removed and result in an error
+func (cd *ComposeDocument) DeleteBlacklisted(blacklist []string) error {
+	services := cd.services()
+	if services == nil {
+		return nil
+	}
+	_bl := make(map[string]int)
+	for _, svc := range blacklist {
+		_bl[svc] = 1
+	}
+
+	content := make([]*yaml.Node, 0, len(services.Content))
+	var removed []*yaml.Node
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		if _, ok := _bl[services.Content[i].Value]; ok {
+			removed = append(removed, services.Content[i], services.Content[i+1])
+			continue
+		}
+		content = append(content, services.Content[i], services.Content[i+1])
+	}
+
+	_services := services.Content
+	services.Content = content
+	if anchor := danglingAnchor(cd.root, removed); anchor != "" {
+		services.Content = _services
+		return fmt.Errorf("Could not delete blacklisted services: anchor '&%v' is still referenced", anchor)
+	}
+
+	cd.EnsureDependencies()
+	return nil
+}
+
+// EnsureDependencies removes dependencies that are not present in the
+// document. Both the short (list) and long (mapping) depends_on syntax are
+// supported
+func (cd *ComposeDocument) EnsureDependencies() {
+	services := cd.services()
+	if services == nil {
+		return
+	}
+	for i := 1; i < len(services.Content); i += 2 {
+		svc := resolveNode(services.Content[i])
+		dependsOn, own := serviceValue(svc, "depends_on")
+		if dependsOn == nil {
+			continue
+		}
+
+		var kept []*yaml.Node
+		changed := false
+		switch dependsOn.Kind {
+		case yaml.SequenceNode:
+			for _, dep := range dependsOn.Content {
+				if !cd.HasService(resolveNode(dep).Value) {
+					changed = true
+					continue
+				}
+				kept = append(kept, dep)
+			}
+		case yaml.MappingNode:
+			for j := 0; j+1 < len(dependsOn.Content); j += 2 {
+				if !cd.HasService(dependsOn.Content[j].Value) {
+					changed = true
+					continue
+				}
+				kept = append(kept, dependsOn.Content[j], dependsOn.Content[j+1])
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if len(kept) == 0 && own {
+			mappingDelete(svc, "depends_on")
+			continue
+		}
+		if !own {
+			// The dependencies are inherited through a merge key, so the
+			// shared node is left alone and the service receives its own copy
+			dependsOn = copyNode(dependsOn)
+			mappingSet(svc, "depends_on", dependsOn)
+		}
+		dependsOn.Content = kept
+	}
+}
+
+// ApplyOptions performs the same port rewrites and HTTPS setup that
+// ComposeFile.Write does on the document. The filename is the compose file
+// that the document is about to be written to, which is where self-signed
+// certificates are generated
+func (cd *ComposeDocument) ApplyOptions(filename string, options map[string]interface{}) error {
+	wo := parseWriteOptions(options)
+	services := cd.services()
+	if services == nil {
+		return nil
+	}
+
+	if _, router := mappingGet(services, routerService); router != nil && wo.rewritesRouterPorts() {
+		router = resolveNode(router)
+		ports, own := serviceValue(router, "ports")
+		if ports == nil && wo.https {
+			ports, own = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}, false
+		}
+		if ports != nil && ports.Kind == yaml.SequenceNode {
+			if !own {
+				ports = copyNode(ports)
+				mappingSet(router, "ports", ports)
+			}
+			kept := make([]*yaml.Node, 0, len(ports.Content)+1)
+			hasHTTPS := false
+			for _, port := range ports.Content {
+				if port.Kind != yaml.ScalarNode {
+					kept = append(kept, port)
+					continue
+				}
+				hasHTTPS = hasHTTPS || strings.HasSuffix(port.Value, ":443")
+				p, keep := wo.rewriteRouterPort(port.Value)
+				if !keep {
+					continue
+				}
+				port.Value = p
+				kept = append(kept, port)
+			}
+			if wo.https && !hasHTTPS {
+				kept = append(kept, stringNode(wo.tls.portMapping()))
+			}
+			ports.Content = kept
+		}
+	}
+
+	if wo.https {
+		if err := cd.applyTLS(wo.tls, filename); err != nil {
+			return err
+		}
+	}
+
+	if wo.suppressPorts {
+		for i := 0; i+1 < len(services.Content); i += 2 {
+			if services.Content[i].Value == routerService {
+				continue
+			}
+			svc := resolveNode(services.Content[i+1])
+			ports, own := serviceValue(svc, "ports")
+			if ports == nil {
+				continue
+			}
+			if own {
+				mappingDelete(svc, "ports")
+				continue
+			}
+			// Inherited ports can only be suppressed by overriding them
+			mappingSet(svc, "ports", &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle})
+		}
+	}
+
+	if wo.dbPort != defaultDBPort {
+		if _, db := mappingGet(services, dbService); db != nil {
+			db = resolveNode(db)
+			ports, own := serviceValue(db, "ports")
+			if ports == nil || !own || ports.Kind != yaml.SequenceNode {
+				ports = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+				mappingSet(db, "ports", ports)
+			}
+			if len(ports.Content) == 0 {
+				ports.Style = 0
+			}
+			ports.Content = []*yaml.Node{stringNode(wo.dbPortMapping())}
+		}
+	}
+	return nil
+}
+
+// applyTLS declares the certificate and key secrets in the document and
+// mounts them into the router, see ComposeFile.applyTLS
+func (cd *ComposeDocument) applyTLS(tc TLSConfig, filename string) error {
+	_, router := mappingGet(cd.services(), routerService)
+	if router == nil || !tc.hasCertificate() {
+		return nil
+	}
+	router = resolveNode(router)
+	mounted, own := serviceValue(router, "secrets")
+	if mounted != nil && mounted.Kind != yaml.SequenceNode {
+		return fmt.Errorf("Could not mount the certificate: the secrets of the %v service are not a list", routerService)
+	}
+	certFile, keyFile, err := tc.certificateFiles(filename)
+	if err != nil {
+		return err
+	}
+
+	root := resolveNode(cd.root.Content[0])
+	_, secrets := mappingGet(root, "secrets")
+	if secrets == nil || secrets.Kind != yaml.MappingNode {
+		secrets = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		mappingSet(root, "secrets", secrets)
+	}
+	if mounted == nil {
+		mounted = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		mappingSet(router, "secrets", mounted)
+	} else if !own {
+		// The secrets are inherited through a merge key, so the router
+		// receives its own copy
+		mounted = copyNode(mounted)
+		mappingSet(router, "secrets", mounted)
+	}
+	for _, secret := range []struct{ name, file string }{{routerCertSecret, certFile}, {routerKeySecret, keyFile}} {
+		mappingSet(secrets, secret.name, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+			plainNode("file"), stringNode(secret.file),
+		}})
+		if !mountsSecret(mounted, secret.name) {
+			mounted.Content = append(mounted.Content, plainNode(secret.name))
+		}
+	}
+	return nil
+}
+
+// mountsSecret reports whether the secrets list of a service refers to the
+// given secret, in either the short or the long syntax
+func mountsSecret(mounted *yaml.Node, secret string) bool {
+	for _, n := range mounted.Content {
+		n = resolveNode(n)
+		if n.Kind == yaml.ScalarNode && n.Value == secret {
+			return true
+		}
+		if _, source := mappingGet(n, "source"); source != nil && source.Value == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes marshals the document, using the indentation of the original file
+func (cd *ComposeDocument) Bytes() ([]byte, error) {
+	untagMergeKeys(cd.root)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(cd.indent)
+	if err := enc.Encode(cd.root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write applies the given options to the document and writes it to the
+// given filename. See ComposeFile.Write for the supported options
+func (cd *ComposeDocument) Write(filename string, options map[string]interface{}) error {
+	if err := cd.ApplyOptions(filename, options); err != nil {
+		return fmt.Errorf("Could not write '%v': %v", filename, err)
+	}
+	_cd, err := cd.Bytes()
+	if err != nil {
+		return fmt.Errorf("Could not write '%v': %v", filename, err.Error())
+	}
+	return ioutil.WriteFile(filename, _cd, 0644)
+}
+
+// services returns the mapping node found under the "services" key
+func (cd *ComposeDocument) services() *yaml.Node {
+	_, services := mappingGet(resolveNode(cd.root.Content[0]), "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return nil
+	}
+	return services
+}
+
+// resolveNode follows aliases through to the node that they refer to
+func resolveNode(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// mappingGet returns the index of the key node and the resolved value node
+// of key in the mapping m. Merge keys are not followed
+func mappingGet(m *yaml.Node, key string) (int, *yaml.Node) {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return -1, nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i, resolveNode(m.Content[i+1])
+		}
+	}
+	return -1, nil
+}
+
+// serviceValue looks key up in the service mapping, falling back to values
+// merged in with "<<". The second return value reports whether the value is
+// defined on the service itself, which means it can be edited in place
+func serviceValue(svc *yaml.Node, key string) (*yaml.Node, bool) {
+	if _, v := mappingGet(svc, key); v != nil {
+		return v, true
+	}
+	_, merge := mappingGet(svc, "<<")
+	if merge == nil {
+		return nil, false
+	}
+	sources := []*yaml.Node{merge}
+	if merge.Kind == yaml.SequenceNode {
+		sources = merge.Content
+	}
+	for _, src := range sources {
+		if v, _ := serviceValue(resolveNode(src), key); v != nil {
+			return v, false
+		}
+	}
+	return nil, false
+}
+
+// mappingSet replaces the value of key in m, appending the key if it is not
+// yet present. Comments on an existing key are kept
+func mappingSet(m *yaml.Node, key string, value *yaml.Node) {
+	if i, _ := mappingGet(m, key); i >= 0 {
+		m.Content[i+1] = value
+		return
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// mappingDelete removes key and its value from m
+func mappingDelete(m *yaml.Node, key string) {
+	if i, _ := mappingGet(m, key); i >= 0 {
+		m.Content = append(m.Content[:i], m.Content[i+2:]...)
+	}
+}
+
+// copyNode deep-copies n, dropping anchors so that the copy can live next to
+// the original without clashing
+func copyNode(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	_n := *n
+	_n.Anchor = ""
+	if n.Kind != yaml.AliasNode {
+		_n.Content = make([]*yaml.Node, len(n.Content))
+		for i, c := range n.Content {
+			_n.Content[i] = copyNode(c)
+		}
+	}
+	return &_n
+}
+
+// untagMergeKeys clears the explicit tag that yaml.v3 attaches to "<<" keys
+// when decoding, which it would otherwise print as "!!merge <<"
+func untagMergeKeys(n *yaml.Node) {
+	if n.Kind == yaml.AliasNode {
+		return
+	}
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == "<<" {
+				n.Content[i].Tag = ""
+			}
+		}
+	}
+	for _, c := range n.Content {
+		untagMergeKeys(c)
+	}
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.DoubleQuotedStyle, Value: value}
+}
+
+// danglingAnchor returns the name of an anchor defined in one of the removed
+// nodes that is still aliased from the document, or an empty string
+func danglingAnchor(root *yaml.Node, removed []*yaml.Node) string {
+	anchors := make(map[*yaml.Node]bool)
+	var collect func(n *yaml.Node)
+	collect = func(n *yaml.Node) {
+		if n.Anchor != "" {
+			anchors[n] = true
+		}
+		if n.Kind == yaml.AliasNode {
+			return
+		}
+		for _, c := range n.Content {
+			collect(c)
+		}
+	}
+	for _, n := range removed {
+		collect(n)
+	}
+	if len(anchors) == 0 {
+		return ""
+	}
+
+	var find func(n *yaml.Node) string
+	find = func(n *yaml.Node) string {
+		if n.Kind == yaml.AliasNode {
+			if anchors[n.Alias] {
+				return n.Alias.Anchor
+			}
+			return ""
+		}
+		for _, c := range n.Content {
+			if a := find(c); a != "" {
+				return a
+			}
+		}
+		return ""
+	}
+	return find(root)
+}
+
+// detectIndent guesses the indentation width of a yml file from its first
+// indented line, defaulting to 2 spaces
+func detectIndent(content []byte) int {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		if n := len(line) - len(trimmed); n > 0 {
+			return n
+		}
+	}
+	return 2
+}
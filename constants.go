@@ -12,8 +12,17 @@ type Attribute string
 type Attributes []Attribute
 
 const (
-	mountDir   = "tmp"
-	routerPort = "80:80"
+	mountDir      = "tmp"
+	routerPort    = "80:80"
+	defaultDBPort = 5432
+
+	// The services that compose generation treats specially
+	routerService = "router"
+	dbService     = "db"
+	dbPoolService = "dbpool"
+
+	inhouseImagePrefix     = "imqs/"
+	waitForPostgresCommand = "wait-for-nc.sh config:80 -- wait-for-postgres.sh db"
 )
 
 func joinMountDir(filepath Attribute) Attribute {
@@ -75,16 +84,11 @@ func (m *Attributes) Remove(value string) {
 	if m == nil || len(*m) == 0 {
 		return
 	}
-	outArray := make([]Attribute, len(*m)-1)
-	offset := 0
-	for i := 0; i < len(*m); i++ {
-		if (*m)[i].String() == value {
-			offset++
-			if len(*m)+offset >= len(*m) {
-				break
-			}
+	outArray := make([]Attribute, 0, len(*m))
+	for _, _m := range *m {
+		if !_m.Equals(value) {
+			outArray = append(outArray, _m)
 		}
-		outArray[i] = (*m)[i+offset]
 	}
 	*m = Attributes(outArray)
 }
@@ -0,0 +1,143 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// delvePort is the port that delve listens on inside the container
+	delvePort = 2345
+	// sourceMountDir is where the source of a service is mounted when it is
+	// rebuilt on change
+	sourceMountDir = "/src"
+)
+
+// DebugConfig selects the in-house services that are run under delve. The
+// image of those services has to provide dlv, and reflex and the Go
+// toolchain too when the source is mounted
+type DebugConfig struct {
+	Services []string
+	// Port is the host port of the first service's delve port, the next
+	// services get the ports after it. It defaults to 2345
+	Port int
+	// SourceDir is the host directory that holds the checkouts of the
+	// repositories. When it is set, the repository of each service, as named
+	// by RepoName, is mounted into the container and rebuilt from the
+	// package at BinPath whenever a Go file changes
+	SourceDir string
+}
+
+func (dc DebugConfig) port(i int) int {
+	if dc.Port == 0 {
+		return delvePort + i
+	}
+	return dc.Port + i
+}
+
+// DebugOverlay returns a compose file that is meant to be passed to docker
+// compose after the generated one, e.g.
+//
+//	docker compose -f docker-compose.yml -f docker-compose.debug.yml up
+//
+// It only holds the values that the selected services need to run under
+// delve: the delve port, the dlv command, SYS_PTRACE and the source mount
+func (rf *RegistryFile) DebugOverlay(cfg DebugConfig) (ComposeFile, error) {
+	cf := ComposeFile{Version: composeVersion, Services: make(map[string]*Service, len(cfg.Services))}
+	for i, name := range cfg.Services {
+		svc, err := rf.debugService(name)
+		if err != nil {
+			return ComposeFile{}, err
+		}
+		cf.Services[svc.Container] = svc.debugOverlay(cfg, i)
+	}
+	return cf, nil
+}
+
+// DebugTransformer applies the debug overlay of the selected services to
+// the compose file itself, for when a single file is preferred
+type DebugTransformer struct {
+	Config DebugConfig
+}
+
+// Transform implements Transformer
+func (t DebugTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	overlay, err := rf.DebugOverlay(t.Config)
+	if err != nil {
+		return err
+	}
+	for name, o := range overlay.Services {
+		svc, ok := cf.Services[name]
+		if !ok {
+			return fmt.Errorf("Could not debug '%v': the service is not part of the compose file", name)
+		}
+		svc.DockerComposePort = svc.DockerComposePort.And(o.DockerComposePort...)
+		svc.Command = o.Command
+		svc.CapAdd = svc.CapAdd.And(o.CapAdd...)
+		svc.SecurityOpt = svc.SecurityOpt.And(o.SecurityOpt...)
+		svc.Volumes = append(svc.Volumes, o.Volumes...)
+		if o.WorkingDir != "" {
+			svc.WorkingDir = o.WorkingDir
+		}
+	}
+	return nil
+}
+
+// debugService looks up a service that can be debugged, which is one that is
+// built in-house
+func (rf *RegistryFile) debugService(name string) (Service, error) {
+	i := rf.serviceIndex(name)
+	if i < 0 {
+		return Service{}, fmt.Errorf("Could not debug '%v': service not found in the service registry", name)
+	}
+	svc := rf.Services[i]
+	if svc.Container == "" || svc.Image != "" || svc.IsExternalImage {
+		return Service{}, fmt.Errorf("Could not debug '%v': only containerized in-house services can be debugged", name)
+	}
+	return svc, nil
+}
+
+// debugOverlay returns the overlay of the i-th debugged service
+func (s Service) debugOverlay(cfg DebugConfig, i int) *Service {
+	o := &Service{
+		DockerComposePort: Attributes{Attribute(fmt.Sprintf("%v:%v:%v", defaultBindAddress, cfg.port(i), delvePort))},
+		CapAdd:            Attributes{"SYS_PTRACE"},
+		SecurityOpt:       Attributes{"seccomp:unconfined"},
+	}
+	dlv := fmt.Sprintf("--headless --listen=:%v --api-version=2 --accept-multiclient --continue", delvePort)
+	if cfg.SourceDir == "" {
+		o.Command = fmt.Sprintf("dlv %v exec /opt/%v", dlv, pickBinaryName(s.Container))
+	} else {
+		repo := s.repoName()
+		o.WorkingDir = path.Join(sourceMountDir, repo)
+		o.Volumes = []Attribute{Attribute(filepath.Join(cfg.SourceDir, repo) + ":" + o.WorkingDir)}
+		// "$$" keeps docker compose from interpolating the regular expression
+		o.Command = fmt.Sprintf(`reflex -r '\.go$$' -s -- dlv debug %v %v`, dlv, s.packagePath())
+	}
+	if s.DependsOnDB() {
+		o.Command = waitForPostgresCommand + " " + o.Command
+	}
+	return o
+}
+
+// repoName returns the repository of the service, falling back to its
+// container name
+func (s Service) repoName() string {
+	if s.RepoName == "" {
+		return s.Container
+	}
+	return s.RepoName
+}
+
+// packagePath returns the Go package that the service binary is built from,
+// relative to the root of its repository
+func (s Service) packagePath() string {
+	p := strings.Trim(filepath.ToSlash(s.BinPath), "/")
+	if p == "" || p == "." {
+		return "."
+	}
+	return "./" + p
+}
@@ -2,8 +2,4 @@ module github.com/jasonkofo/containerutils
 
 go 1.16
 
-require (
-	github.com/PeteProgrammer/go-automapper v0.0.0-20200419053654-7c63d5bb0eb4
-	github.com/stretchr/testify v1.7.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
-)
+require gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
@@ -0,0 +1,135 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+const (
+	dockerHost        = "host.docker.internal"
+	dockerHostGateway = dockerHost + ":host-gateway"
+)
+
+// HybridMode returns a developer mode in which the given services run on the
+// host, e.g. from an IDE, while the rest of the stack runs in containers
+func HybridMode(local ...string) Mode {
+	m := DeveloperMode.clone()
+	m.Name = "hybrid"
+	m.Local = append([]string{}, local...)
+	return m
+}
+
+// HybridTransformer leaves the local services out of the compose file and
+// points the services that talk to them at the host instead: the services
+// that depend on them, through depends_on or the registry, reach the host
+// through host.docker.internal, and "<container>:<port>" in their
+// environment and command is rewritten to the port that the local service
+// listens on according to the registry
+type HybridTransformer struct {
+	Local []string
+}
+
+// Transform implements Transformer
+func (t HybridTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	for _, name := range t.Local {
+		i := rf.serviceIndex(name)
+		if i < 0 {
+			return fmt.Errorf("Could not run '%v' locally: service not found in the service registry", name)
+		}
+		local := rf.Services[i]
+		// The dependents are found before the local service is left out, as
+		// the dependencies of the registry only count services of the file
+		dependents := make(map[string]bool)
+		for _, svcName := range cf.serviceNames() {
+			dependents[svcName] = containsString(rf.dependenciesOf(svcName, cf), local.Container)
+		}
+		delete(cf.Services, local.Container)
+
+		rewrites := local.hostRewrites()
+		for _, svcName := range cf.serviceNames() {
+			svc := cf.Services[svcName]
+			dependent := dependents[svcName]
+			if svc.DependsOn.Contains(local.Container) {
+				svc.DependsOn.Remove(local.Container)
+			}
+			if svc.rewriteHosts(rewrites) || dependent || svcName == routerService {
+				if !svc.ExtraHosts.Contains(dockerHostGateway) {
+					svc.ExtraHosts = svc.ExtraHosts.And(Attribute(dockerHostGateway))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hostRewrite replaces the address of a container with the host address of
+// the same service when it runs locally
+type hostRewrite struct {
+	pattern *regexp.Regexp
+	address string
+}
+
+// hostRewrites returns the rewrites of every port of the service
+func (s Service) hostRewrites() []hostRewrite {
+	var rewrites []hostRewrite
+	for _, port := range s.Port {
+		container := regexp.QuoteMeta(s.Container + ":" + s.pickInnerPort(port))
+		rewrites = append(rewrites, hostRewrite{
+			pattern: regexp.MustCompile(`(^|[^A-Za-z0-9_.-])` + container + `($|[^0-9])`),
+			address: dockerHost + ":" + strconv.Itoa(port),
+		})
+	}
+	return rewrites
+}
+
+// rewriteHosts applies the rewrites to the environment and command of the
+// service, reporting whether anything changed
+func (s *Service) rewriteHosts(rewrites []hostRewrite) bool {
+	rewrite := func(v string) string {
+		for _, r := range rewrites {
+			// The pattern consumes the characters around the address, so
+			// back-to-back addresses such as "auth:2003,auth:2003" take
+			// more than one pass
+			for {
+				_v := r.pattern.ReplaceAllString(v, "${1}"+r.address+"${2}")
+				if _v == v {
+					break
+				}
+				v = _v
+			}
+		}
+		return v
+	}
+	changed := false
+	for k, v := range s.Environment {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if _str := rewrite(str); _str != str {
+			s.Environment[k] = _str
+			changed = true
+		}
+	}
+	if command := rewrite(s.Command); command != s.Command {
+		s.Command = command
+		changed = true
+	}
+	return changed
+}
+
+// RoutesForMode returns the routes of the registry, where the routes of the
+// services that the mode runs locally point at the host
+func (rf *RegistryFile) RoutesForMode(mode Mode) []Route {
+	routes := rf.Routes()
+	for i, r := range routes {
+		j := rf.serviceIndex(r.Service)
+		if j < 0 || !(containsString(mode.Local, r.Service) || containsString(mode.Local, r.Container)) {
+			continue
+		}
+		routes[i].Address = dockerHost + ":" + strconv.Itoa(rf.Services[j].Port[0])
+	}
+	return routes
+}
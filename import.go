@@ -0,0 +1,272 @@
+package containerutils
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Warning describes something that could not be carried over faithfully
+// while converting between compose files and the service registry
+type Warning struct {
+	Service string
+	Field   string
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Service == "" {
+		return fmt.Sprintf("%v: %v", w.Field, w.Message)
+	}
+	return fmt.Sprintf("%v.%v: %v", w.Service, w.Field, w.Message)
+}
+
+// importedFields are the compose fields that ImportCompose knows how to map
+// back onto registry fields. Any other populated field produces a Warning
+var importedFields = map[string]bool{
+	"image":       true,
+	"ports":       true,
+	"depends_on":  true,
+	"environment": true,
+	"secrets":     true,
+	"profiles":    true,
+	"networks":    true,
+}
+
+// ImportCompose builds a RegistryFile from an existing docker-compose file.
+// The image, ports, depends_on and environment of each compose service are
+// mapped back into registry fields, inferring Container, Port, Port80InDocker,
+// DefaultTag and IsExternalImage along the way. Everything that cannot be
+// represented in the service-registry.json is reported as a Warning
+func ImportCompose(cf *ComposeFile) (RegistryFile, []Warning) {
+	rf := RegistryFile{}
+	var warnings []Warning
+	if cf == nil {
+		return rf, warnings
+	}
+
+	names := cf.serviceNames()
+
+	for _, name := range names {
+		svc, w := importService(name, cf.Services[name])
+		rf.Services = append(rf.Services, svc)
+		warnings = append(warnings, w...)
+	}
+
+	for _, name := range sortedTopLevelNames(cf.Secrets) {
+		def, err := importSecret(cf.Secrets[name])
+		if err != nil {
+			warnings = append(warnings, Warning{Field: "secrets." + name, Message: err.Error()})
+			continue
+		}
+		if rf.Secrets == nil {
+			rf.Secrets = make(map[string]SecretDefinition)
+		}
+		rf.Secrets[name] = def
+	}
+	for _, name := range sortedTopLevelNames(cf.Networks) {
+		def, err := importNetwork(cf.Networks[name])
+		if err != nil {
+			warnings = append(warnings, Warning{Field: "networks." + name, Message: err.Error()})
+			continue
+		}
+		if rf.Networks == nil {
+			rf.Networks = make(map[string]NetworkDefinition)
+		}
+		rf.Networks[name] = def
+	}
+	return rf, warnings
+}
+
+func importService(name string, cs *Service) (Service, []Warning) {
+	svc := Service{Name: name, Container: name}
+	var warnings []Warning
+	warn := func(field, format string, args ...interface{}) {
+		warnings = append(warnings, Warning{Service: name, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	if cs == nil {
+		return svc, warnings
+	}
+
+	repo, tag, digest := splitImage(cs.Image)
+	switch {
+	case cs.Image == "":
+		warn("image", "no image is specified, assuming the in-house image %v%v", inhouseImagePrefix, name)
+	case repo == inhouseImagePrefix+name:
+		if tag != "latest" {
+			svc.DefaultTag = tag
+		}
+		if digest != "" {
+			warn("image", "the digest '%v' is dropped, the registry only stores tags", digest)
+		}
+	default:
+		svc.Image = cs.Image
+		svc.IsExternalImage = true
+		warn("image", "'%v' is an external image, which cannot be stored in service-registry.json", cs.Image)
+	}
+
+	type mapping struct {
+		port     Attribute
+		hostPort int
+		inner    string
+	}
+	var mappings []mapping
+	for _, port := range cs.DockerComposePort {
+		_, host, inner, err := parsePortMapping(port.String())
+		if err != nil {
+			warn("ports", "%v", err)
+			continue
+		}
+		if host == "" {
+			warn("ports", "'%v' does not publish a host port", port)
+			continue
+		}
+		hostPort, err := strconv.Atoi(host)
+		if err != nil {
+			warn("ports", "'%v' uses a port range, which is not supported", port)
+			continue
+		}
+		mappings = append(mappings, mapping{port: port, hostPort: hostPort, inner: inner})
+		svc.Port = append(svc.Port, hostPort)
+	}
+	// Port80InDocker applies to every port of the service, so it is only set
+	// when all of the mappings target port 80
+	allTo80, remapped := len(mappings) > 0, false
+	for _, m := range mappings {
+		allTo80 = allTo80 && m.inner == "80"
+		remapped = remapped || m.hostPort != 80
+	}
+	svc.Port80InDocker = allTo80 && remapped
+	for _, m := range mappings {
+		if inner := svc.pickInnerPort(m.hostPort); m.inner != inner {
+			warn("ports", "'%v' maps onto inner port %v, but is regenerated onto inner port %v", m.port, m.inner, inner)
+		}
+	}
+
+	for _, dep := range cs.DependsOn {
+		svc.Dependencies = append(svc.Dependencies, dep.String())
+		svc.DependsOn = svc.DependsOn.And(dep)
+	}
+
+	if len(cs.Environment) > 0 {
+		svc.Environment = make(map[string]interface{}, len(cs.Environment))
+		for k, v := range cs.Environment {
+			svc.Environment[k] = v
+		}
+		warn("environment", "the environment is kept on the service, but is not written to service-registry.json")
+	}
+
+	svc.Secrets = append(svc.Secrets, cs.Secrets...)
+	svc.Networks = append(svc.Networks, cs.Networks...)
+	for _, p := range cs.Profiles {
+		svc.Groups = append(svc.Groups, p.String())
+	}
+
+	if cs.Command != "" && !strings.HasPrefix(cs.Command, waitForPostgresCommand) {
+		svc.Command = cs.Command
+		warn("command", "custom commands cannot be stored in service-registry.json")
+	}
+
+	v := reflect.ValueOf(*cs)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" || tag == "command" || importedFields[tag] {
+			continue
+		}
+		if !v.Field(i).IsZero() {
+			warn(tag, "this field is not represented in the service registry")
+		}
+	}
+	return svc, warnings
+}
+
+// importSecret converts a top-level compose secret into a SecretDefinition
+func importSecret(secret map[string]interface{}) (SecretDefinition, error) {
+	def := SecretDefinition{}
+	for k, v := range secret {
+		switch k {
+		case "file":
+			def.File, _ = v.(string)
+		case "external":
+			def.External, _ = v.(bool)
+		case "name":
+			def.Name, _ = v.(string)
+		default:
+			return def, fmt.Errorf("the '%v' option is not represented in the service registry", k)
+		}
+	}
+	return def, nil
+}
+
+// importNetwork converts a top-level compose network into a NetworkDefinition
+func importNetwork(network map[string]interface{}) (NetworkDefinition, error) {
+	def := NetworkDefinition{}
+	for k, v := range network {
+		switch k {
+		case "driver":
+			def.Driver, _ = v.(string)
+		case "internal":
+			def.Internal, _ = v.(bool)
+		case "external":
+			def.External, _ = v.(bool)
+		case "name":
+			def.Name, _ = v.(string)
+		case "ipam":
+			ipam, _ := v.(map[string]interface{})
+			config, _ := ipam["config"].([]interface{})
+			if len(ipam) != 1 || len(config) != 1 {
+				return def, fmt.Errorf("only a single ipam subnet is represented in the service registry")
+			}
+			subnet, _ := config[0].(map[string]interface{})
+			def.Subnet, _ = subnet["subnet"].(string)
+		default:
+			return def, fmt.Errorf("the '%v' option is not represented in the service registry", k)
+		}
+	}
+	return def, nil
+}
+
+// sortedTopLevelNames returns the keys of a top-level secrets or networks
+// section in alphabetical order
+func sortedTopLevelNames(section map[string]map[string]interface{}) []string {
+	names := make([]string, 0, len(section))
+	for name := range section {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitImage splits an image reference into its repository, tag and digest.
+// The tag is empty when the reference does not carry one
+func splitImage(image string) (repo, tag, digest string) {
+	repo = image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, digest = repo[:i], repo[i+1:]
+	}
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	return repo, tag, digest
+}
+
+// parsePortMapping splits a short-syntax compose port ("ip:host:inner",
+// "host:inner" or "inner") into its parts
+func parsePortMapping(port string) (ip, host, inner string, err error) {
+	if strings.Contains(port, "/") {
+		return "", "", "", fmt.Errorf("'%v' specifies a protocol, which is not supported", port)
+	}
+	parts := strings.Split(port, ":")
+	switch len(parts) {
+	case 1:
+		return "", "", parts[0], nil
+	case 2:
+		return "", parts[0], parts[1], nil
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	}
+	return "", "", "", fmt.Errorf("'%v' is not a valid port mapping", port)
+}
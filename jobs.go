@@ -0,0 +1,197 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The conditions that a service can wait on in its depends_on
+const (
+	ConditionStarted               = "service_started"
+	ConditionHealthy               = "service_healthy"
+	ConditionCompletedSuccessfully = "service_completed_successfully"
+)
+
+// restartNever is the restart policy of one-shot jobs
+const restartNever = "no"
+
+// JobTransformer turns the registry jobs into one-shot services that are
+// never restarted, and makes every service that depends on a job, including
+// other jobs, wait until the job has completed successfully
+type JobTransformer struct{}
+
+// Transform implements Transformer
+func (JobTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	jobs := make(map[string]bool)
+	for _, svc := range rf.Services {
+		if _, ok := cf.Services[svc.Container]; ok && svc.Job {
+			jobs[svc.Container] = true
+		}
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	for _, name := range cf.serviceNames() {
+		svc := cf.Services[name]
+		if jobs[name] {
+			svc.Restart = restartNever
+		}
+		for _, dep := range rf.dependenciesOf(name, cf) {
+			if !jobs[dep] {
+				continue
+			}
+			if !svc.DependsOn.Contains(dep) {
+				svc.DependsOn = svc.DependsOn.And(Attribute(dep))
+			}
+			svc.setDependencyCondition(dep, ConditionCompletedSuccessfully)
+		}
+	}
+	return cf.checkJobOrder(jobs)
+}
+
+// checkJobOrder fails when jobs wait on each other in a cycle, which would
+// keep all of them from ever starting
+func (cf *ComposeFile) checkJobOrder(jobs map[string]bool) error {
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("The jobs wait on each other: %v", strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range cf.Services[name].DependsOn {
+			if jobs[dep.String()] {
+				if err := visit(dep.String(), append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, name := range sortedKeys(jobs) {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JobOrder returns the jobs of the compose file in the order in which they
+// run, so that every job comes after the jobs that it waits on
+func (cf *ComposeFile) JobOrder() []string {
+	var order []string
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		svc := cf.Services[name]
+		for _, dep := range svc.DependsOn {
+			if _, ok := cf.Services[dep.String()]; ok && svc.DependencyCondition(dep.String()) == ConditionCompletedSuccessfully {
+				visit(dep.String())
+			}
+		}
+		if svc.Restart == restartNever {
+			order = append(order, name)
+		}
+	}
+	for _, name := range cf.serviceNames() {
+		visit(name)
+	}
+	return order
+}
+
+// DependencyCondition returns the condition that the service waits on
+// before it starts after the given dependency
+func (s *Service) DependencyCondition(dependency string) string {
+	if c, ok := s.DependsOnCondition[dependency]; ok {
+		return c
+	}
+	return ConditionStarted
+}
+
+func (s *Service) setDependencyCondition(dependency, condition string) {
+	if s.DependsOnCondition == nil {
+		s.DependsOnCondition = make(map[string]string)
+	}
+	s.DependsOnCondition[dependency] = condition
+}
+
+// hasDependencyConditions reports whether depends_on needs the long syntax
+func (s Service) hasDependencyConditions() bool {
+	for _, dep := range s.DependsOn {
+		if s.DependencyCondition(dep.String()) != ConditionStarted {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalYAML writes depends_on in the long syntax when the service waits on
+// a condition other than the start of a dependency
+func (s Service) MarshalYAML() (interface{}, error) {
+	type plain Service
+	if !s.hasDependencyConditions() {
+		return plain(s), nil
+	}
+	n := &yaml.Node{}
+	if err := n.Encode(plain(s)); err != nil {
+		return nil, err
+	}
+	deps := &yaml.Node{Kind: yaml.MappingNode}
+	for _, dep := range s.DependsOn {
+		condition := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			plainNode("condition"), plainNode(s.DependencyCondition(dep.String())),
+		}}
+		deps.Content = append(deps.Content, plainNode(dep.String()), condition)
+	}
+	mappingSet(n, "depends_on", deps)
+	return n, nil
+}
+
+// UnmarshalYAML accepts both the list and the long syntax of depends_on
+func (s *Service) UnmarshalYAML(value *yaml.Node) error {
+	type plain Service
+	_, deps := mappingGet(value, "depends_on")
+	if deps == nil || deps.Kind != yaml.MappingNode {
+		return value.Decode((*plain)(s))
+	}
+
+	conditions := make(map[string]string)
+	list := &yaml.Node{Kind: yaml.SequenceNode}
+	for i := 0; i+1 < len(deps.Content); i += 2 {
+		name := deps.Content[i].Value
+		list.Content = append(list.Content, plainNode(name))
+		if _, c := mappingGet(resolveNode(deps.Content[i+1]), "condition"); c != nil && c.Value != ConditionStarted {
+			conditions[name] = c.Value
+		}
+	}
+	_value := *value
+	_value.Content = append([]*yaml.Node{}, value.Content...)
+	mappingSet(&_value, "depends_on", list)
+	if err := _value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	if len(conditions) > 0 {
+		s.DependsOnCondition = conditions
+	}
+	return nil
+}
+
+func plainNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
@@ -0,0 +1,238 @@
+package containerutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ociRefNameAnnotation     = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation = "io.containerd.image.name"
+	imageLockVersion         = 1
+	defaultImageTag          = "latest"
+)
+
+// ImageLock pins image references (name:tag) to their sha256 digests so that
+// two deployments of the same tag are guaranteed to run the same images
+type ImageLock struct {
+	Version int               `json:"version"`
+	Images  map[string]string `json:"images"`
+}
+
+// DigestResolver looks up the digest of an image reference. It is
+// implemented by OCILayout and can be implemented by a registry client or a
+// stand-in for one
+type DigestResolver interface {
+	ResolveDigest(ref string) (string, error)
+}
+
+// ReadImageLock reads a lock file
+func ReadImageLock(filename string) (ImageLock, error) {
+	l := ImageLock{}
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return l, fmt.Errorf("Could not read '%v': %v", filename, err)
+	}
+	if err = json.Unmarshal(file, &l); err != nil {
+		return l, fmt.Errorf("Could not read '%v' into a native json object: %v", filename, err)
+	}
+	if l.Images == nil {
+		l.Images = make(map[string]string)
+	}
+	return l, nil
+}
+
+// Write writes the lock file with its entries in a stable order
+func (l *ImageLock) Write(filename string) error {
+	l.Version = imageLockVersion
+	b, err := json.MarshalIndent(l, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Could not marshal JSON: %v", err)
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// Update resolves the digest of every given image reference and records it
+// in the lock
+func (l *ImageLock) Update(refs []string, resolver DigestResolver) error {
+	if l.Images == nil {
+		l.Images = make(map[string]string)
+	}
+	for _, ref := range refs {
+		ref = normalizeImageRef(ref)
+		digest, err := resolver.ResolveDigest(ref)
+		if err != nil {
+			return fmt.Errorf("Could not resolve the digest of '%v': %v", ref, err)
+		}
+		if err := validateDigest(digest); err != nil {
+			return fmt.Errorf("Could not lock '%v': %v", ref, err)
+		}
+		l.Images[ref] = digest
+	}
+	return nil
+}
+
+// Digest returns the locked digest of an image reference
+func (l ImageLock) Digest(ref string) (string, bool) {
+	digest, ok := l.Images[normalizeImageRef(ref)]
+	return digest, ok
+}
+
+// Images returns the sorted, normalised image references of the services
+// that are not pinned to a digest yet
+func (cf *ComposeFile) Images() []string {
+	seen := make(map[string]bool)
+	for _, svc := range cf.Services {
+		if _, _, digest := splitImage(svc.Image); svc.Image == "" || digest != "" {
+			continue
+		}
+		seen[normalizeImageRef(svc.Image)] = true
+	}
+	return sortedKeys(seen)
+}
+
+// PinImages rewrites the image of every service to "name:tag@sha256:..."
+// using the lock. Images that are already pinned are left alone. An error
+// listing every image that has no entry in the lock is returned, in which
+// case the compose file is not modified
+func (cf *ComposeFile) PinImages(lock ImageLock) error {
+	if err := cf.CheckImageLock(lock); err != nil {
+		return err
+	}
+	for _, svc := range cf.Services {
+		if _, _, digest := splitImage(svc.Image); svc.Image == "" || digest != "" {
+			continue
+		}
+		digest, _ := lock.Digest(svc.Image)
+		svc.Image = normalizeImageRef(svc.Image) + "@" + digest
+	}
+	return nil
+}
+
+// CheckImageLock fails when an image of the compose file lacks an entry in
+// the lock
+func (cf *ComposeFile) CheckImageLock(lock ImageLock) error {
+	var missing []string
+	for _, ref := range cf.Images() {
+		if _, ok := lock.Digest(ref); !ok {
+			missing = append(missing, ref)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("The image lock has no entry for %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// UpdateImageLock resolves the images of the compose file and writes them
+// to the lock file, keeping the entries of images that are not in use
+func UpdateImageLock(lockFile string, cf *ComposeFile, resolver DigestResolver) error {
+	lock := ImageLock{Images: make(map[string]string)}
+	if fileExists(lockFile) {
+		var err error
+		if lock, err = ReadImageLock(lockFile); err != nil {
+			return err
+		}
+	}
+	if err := lock.Update(cf.Images(), resolver); err != nil {
+		return err
+	}
+	return lock.Write(lockFile)
+}
+
+// OCILayout resolves digests from a local OCI image layout directory, as
+// produced by e.g. "skopeo copy" or "docker buildx build --output type=oci"
+type OCILayout struct {
+	Dir string
+	// Repository is the repository of the images whose reference annotation
+	// only holds a tag, such as "v1.4". Without it, those images are not
+	// matched, as the tag alone does not say which image they are
+	Repository string
+}
+
+type ociIndex struct {
+	Manifests []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// ResolveDigest finds the manifest whose reference annotation matches ref.
+// Annotations that only hold a tag are matched against ref as tags of
+// Repository
+func (o OCILayout) ResolveDigest(ref string) (string, error) {
+	filename := filepath.Join(o.Dir, "index.json")
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("Could not read '%v': %v", filename, err)
+	}
+	index := ociIndex{}
+	if err = json.Unmarshal(file, &index); err != nil {
+		return "", fmt.Errorf("Could not read '%v' into a native json object: %v", filename, err)
+	}
+
+	ref = normalizeImageRef(ref)
+	for _, m := range index.Manifests {
+		if name := m.Annotations[containerdNameAnnotation]; name != "" && sameImage(name, ref) {
+			return m.Digest, nil
+		}
+		name := m.Annotations[ociRefNameAnnotation]
+		if name == "" {
+			continue
+		}
+		if !strings.ContainsAny(name, "/:") {
+			if o.Repository == "" {
+				continue
+			}
+			name = o.Repository + ":" + name
+		}
+		if sameImage(name, ref) {
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("'%v' not found in the OCI layout '%v'", ref, o.Dir)
+}
+
+// StaticDigests is a DigestResolver backed by a map, which is useful as a
+// stand-in for a registry
+type StaticDigests map[string]string
+
+// ResolveDigest looks the reference up in the map
+func (sd StaticDigests) ResolveDigest(ref string) (string, error) {
+	if digest, ok := sd[normalizeImageRef(ref)]; ok {
+		return digest, nil
+	}
+	return "", fmt.Errorf("'%v' is unknown", ref)
+}
+
+// normalizeImageRef drops any digest from an image reference and adds the
+// "latest" tag when it carries none
+func normalizeImageRef(ref string) string {
+	repo, tag, _ := splitImage(ref)
+	if tag == "" {
+		tag = defaultImageTag
+	}
+	return repo + ":" + tag
+}
+
+// sameImage compares two references, ignoring the docker.io registry and
+// library namespace that docker adds to short names
+func sameImage(a, b string) bool {
+	trim := func(ref string) string {
+		ref = normalizeImageRef(ref)
+		ref = strings.TrimPrefix(ref, "docker.io/")
+		return strings.TrimPrefix(ref, "library/")
+	}
+	return trim(a) == trim(b)
+}
+
+func validateDigest(digest string) error {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if hex == digest || len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return fmt.Errorf("'%v' is not a sha256 digest", digest)
+	}
+	return nil
+}
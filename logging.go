@@ -0,0 +1,226 @@
+package containerutils
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The formats that a LogParser can have
+const (
+	LogFormatJSON   = "json"
+	LogFormatRegex  = "regex"
+	LogFormatLogfmt = "logfmt"
+)
+
+const defaultFluentAddress = "localhost:24224"
+
+// LogParser describes how the lines of a log file are parsed. The name is
+// what the "parser" field of a ServiceLogs entry refers to
+type LogParser struct {
+	Name       string `json:"name"`
+	Format     string `json:"format"`
+	Regex      string `json:"regex,omitempty"`
+	TimeKey    string `json:"timeKey,omitempty"`
+	TimeFormat string `json:"timeFormat,omitempty"`
+}
+
+// LogParserCatalogue holds the known log parsers, keyed by name
+type LogParserCatalogue map[string]LogParser
+
+// LogCollectorConfig configures the generated log collection configuration
+type LogCollectorConfig struct {
+	Parsers LogParserCatalogue
+	// LogDir is the directory, as seen by the collector, that relative log
+	// filenames are resolved against
+	LogDir string
+	// FluentAddress is the address of the collector's forward input, used
+	// for the compose logging driver. It defaults to localhost:24224
+	FluentAddress string
+}
+
+// logInput is a single ServiceLogs entry that belongs to a service
+type logInput struct {
+	service string
+	log     ServiceLogs
+}
+
+func (li logInput) tag() string {
+	return li.service + "." + li.log.Name
+}
+
+func (li logInput) id() string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(li.tag())
+}
+
+func (li logInput) path(logDir string) string {
+	if path.IsAbs(li.log.Filename) || logDir == "" {
+		return li.log.Filename
+	}
+	return path.Join(logDir, li.log.Filename)
+}
+
+// logInputs returns the logs of all the services that have not been deposed
+func (rf *RegistryFile) logInputs() []logInput {
+	var inputs []logInput
+	for _, svc := range rf.activeServices() {
+		name := svc.serviceName()
+		for _, l := range svc.Logs {
+			inputs = append(inputs, logInput{service: name, log: l})
+		}
+	}
+	return inputs
+}
+
+// ValidateLogParsers checks that every parser that is referenced by the logs
+// of the registry services exists in the catalogue
+func (rf *RegistryFile) ValidateLogParsers(catalogue LogParserCatalogue) []Warning {
+	var warnings []Warning
+	for _, li := range rf.logInputs() {
+		if li.log.Parser == "" {
+			continue
+		}
+		if _, ok := catalogue[li.log.Parser]; !ok {
+			warnings = append(warnings, Warning{
+				Service: li.service,
+				Field:   "logs",
+				Message: fmt.Sprintf("'%v' refers to the unknown parser '%v'", li.log.Name, li.log.Parser),
+			})
+		}
+	}
+	return warnings
+}
+
+func (rf *RegistryFile) validateLogParsers(catalogue LogParserCatalogue) error {
+	warnings := rf.ValidateLogParsers(catalogue)
+	if len(warnings) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(warnings))
+	for i, w := range warnings {
+		msgs[i] = w.String()
+	}
+	return fmt.Errorf("Could not generate log configuration: %v", strings.Join(msgs, "; "))
+}
+
+// FluentBitConfig generates the Fluent Bit tail inputs for the logs of the
+// registry services, along with the parsers file that they refer to
+func (rf *RegistryFile) FluentBitConfig(cfg LogCollectorConfig) (inputs string, parsers string, err error) {
+	if err := rf.validateLogParsers(cfg.Parsers); err != nil {
+		return "", "", err
+	}
+
+	var sb strings.Builder
+	used := make(map[string]bool)
+	for _, li := range rf.logInputs() {
+		sb.WriteString("[INPUT]\n")
+		sb.WriteString("    Name   tail\n")
+		fmt.Fprintf(&sb, "    Tag    %v\n", li.tag())
+		fmt.Fprintf(&sb, "    Path   %v\n", li.path(cfg.LogDir))
+		if li.log.Parser != "" {
+			fmt.Fprintf(&sb, "    Parser %v\n", li.log.Parser)
+			used[li.log.Parser] = true
+		}
+		sb.WriteString("\n")
+	}
+	inputs = sb.String()
+
+	sb.Reset()
+	for _, name := range sortedKeys(used) {
+		p := cfg.Parsers[name]
+		sb.WriteString("[PARSER]\n")
+		fmt.Fprintf(&sb, "    Name        %v\n", name)
+		fmt.Fprintf(&sb, "    Format      %v\n", p.Format)
+		if p.Regex != "" {
+			fmt.Fprintf(&sb, "    Regex       %v\n", p.Regex)
+		}
+		if p.TimeKey != "" {
+			fmt.Fprintf(&sb, "    Time_Key    %v\n", p.TimeKey)
+		}
+		if p.TimeFormat != "" {
+			fmt.Fprintf(&sb, "    Time_Format %v\n", p.TimeFormat)
+		}
+		sb.WriteString("\n")
+	}
+	return inputs, sb.String(), nil
+}
+
+// VectorConfig generates a Vector (TOML) configuration with a file source
+// for each log of the registry services and a remap transform that applies
+// its parser
+func (rf *RegistryFile) VectorConfig(cfg LogCollectorConfig) (string, error) {
+	if err := rf.validateLogParsers(cfg.Parsers); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, li := range rf.logInputs() {
+		fmt.Fprintf(&sb, "[sources.%v]\n", li.id())
+		sb.WriteString("type = \"file\"\n")
+		fmt.Fprintf(&sb, "include = [%q]\n\n", li.path(cfg.LogDir))
+
+		if li.log.Parser == "" {
+			continue
+		}
+		source, err := vectorRemapSource(cfg.Parsers[li.log.Parser])
+		if err != nil {
+			return "", fmt.Errorf("Could not generate log configuration: %v", err)
+		}
+		fmt.Fprintf(&sb, "[transforms.%v_parsed]\n", li.id())
+		sb.WriteString("type = \"remap\"\n")
+		fmt.Fprintf(&sb, "inputs = [%q]\n", li.id())
+		fmt.Fprintf(&sb, "source = '''\n%v\n.service = %q\n'''\n\n", source, li.service)
+	}
+	return sb.String(), nil
+}
+
+func vectorRemapSource(p LogParser) (string, error) {
+	switch p.Format {
+	case LogFormatJSON:
+		return ". = merge(., parse_json!(.message))", nil
+	case LogFormatLogfmt:
+		return ". = merge(., parse_logfmt!(.message))", nil
+	case LogFormatRegex:
+		return fmt.Sprintf(". = merge(., parse_regex!(.message, r'%v'))", p.Regex), nil
+	}
+	return "", fmt.Errorf("parser '%v' has the unsupported format '%v'", p.Name, p.Format)
+}
+
+// LoggingDriver returns the compose "logging" block that forwards the output
+// of the service to the collector, tagged with the service name
+func (s *Service) LoggingDriver(cfg LogCollectorConfig) map[string]interface{} {
+	address := cfg.FluentAddress
+	if address == "" {
+		address = defaultFluentAddress
+	}
+	return map[string]interface{}{
+		"driver": "fluentd",
+		"options": map[string]interface{}{
+			"fluentd-address": address,
+			"tag":             s.Container,
+		},
+	}
+}
+
+// ApplyLoggingDrivers sets the logging block of every compose service whose
+// registry entry declares logs, leaving other services untouched
+func (cf *ComposeFile) ApplyLoggingDrivers(rf *RegistryFile, cfg LogCollectorConfig) {
+	for _, svc := range rf.activeServices() {
+		if len(svc.Logs) == 0 {
+			continue
+		}
+		if _svc, ok := cf.Services[svc.Container]; ok {
+			_svc.Logging = svc.LoggingDriver(cfg)
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,140 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// MigrationReport describes what happened to the services of an existing
+// compose file when it was regenerated from the service registry
+type MigrationReport struct {
+	// Deposed lists the deposed services that were found in the existing
+	// compose file and have been dropped from the regenerated one
+	Deposed []string
+	// Unmanaged lists the unmanaged services that were carried over from the
+	// existing compose file as-is
+	Unmanaged []string
+	Warnings  []Warning
+}
+
+// HasChanges reports whether the regeneration removed or preserved anything
+// that a person upgrading a live install should know about
+func (mr MigrationReport) HasChanges() bool {
+	return len(mr.Deposed) > 0 || len(mr.Unmanaged) > 0 || len(mr.Warnings) > 0
+}
+
+// IsDeposed reports whether the given service has been deposed, which means
+// that it should no longer be part of any install
+func (rf *RegistryFile) IsDeposed(service string) bool {
+	return containsString(rf.DeposedServices, service)
+}
+
+// IsUnmanaged reports whether the given service is maintained by hand in the
+// compose files of live installs and should not be overwritten
+func (rf *RegistryFile) IsUnmanaged(service string) bool {
+	return containsString(rf.UnmanagedServices, service)
+}
+
+// activeServices returns the registry services that have not been deposed
+func (rf *RegistryFile) activeServices() Services {
+	ss := make(Services, 0, len(rf.Services))
+	for _, svc := range rf.Services {
+		if rf.IsDeposed(svc.Container) || rf.IsDeposed(svc.Name) {
+			continue
+		}
+		ss = append(ss, svc)
+	}
+	return ss
+}
+
+// ToDockerCompose transforms the registry into a compose file with the
+// built-in transformers, leaving out any deposed services and the
+// dependencies on them. The secrets that the services refer to are declared
+// at the top level along with their networks, and service groups are emitted
+// as compose profiles. Use Generate to run the transformers of the mode too.
+// An error is returned for registry mistakes that the built-in transformers
+// run into, such as jobs that wait on each other
+func (rf *RegistryFile) ToDockerCompose(tag string, mode Mode, routerPort int) (ComposeFile, error) {
+	cf := ComposeFile{Version: composeVersion, Services: make(map[string]*Service, len(rf.Services))}
+	cfg := GenerateConfig{Tag: tag, Mode: mode, RouterPort: routerPort}
+	_rf := rf.Clone()
+	if err := builtinPipeline(cfg).Run(context.Background(), &cf, &_rf); err != nil {
+		return ComposeFile{}, fmt.Errorf("Could not generate compose file: %v", err)
+	}
+	return cf, nil
+}
+
+// Regenerate merges a freshly generated compose file with the existing
+// compose file of a live install (typically read with ReadFromFile).
+// Unmanaged services are copied from the existing file rather than being
+// overwritten, and deposed services that are still present in the existing
+// file are dropped and flagged in the returned MigrationReport
+func (rf *RegistryFile) Regenerate(existing *ComposeFile, generated ComposeFile) (ComposeFile, MigrationReport) {
+	report := MigrationReport{}
+	out := ComposeFile{
+		Version:  generated.Version,
+		Name:     generated.Name,
+		Services: make(map[string]*Service, len(generated.Services)),
+	}
+	for name, svc := range generated.Services {
+		if rf.IsDeposed(name) {
+			continue
+		}
+		out.Services[name] = svc
+	}
+	out.adoptReferences(&generated)
+	if existing == nil {
+		return out, report
+	}
+
+	for name, svc := range existing.Services {
+		switch {
+		case rf.IsDeposed(name):
+			report.Deposed = append(report.Deposed, name)
+		case rf.IsUnmanaged(name):
+			out.Services[name] = svc
+			report.Unmanaged = append(report.Unmanaged, name)
+		}
+	}
+	sort.Strings(report.Deposed)
+	sort.Strings(report.Unmanaged)
+	out.adoptReferences(existing)
+
+	// The generated services no longer depend on deposed services, so only
+	// the unmanaged services can still refer to them
+	for _, name := range report.Unmanaged {
+		for _, dep := range out.Services[name].DependsOn {
+			if rf.IsDeposed(dep.String()) {
+				report.Warnings = append(report.Warnings, Warning{
+					Service: name,
+					Field:   "depends_on",
+					Message: fmt.Sprintf("this unmanaged service depends on the deposed service '%v' and has to be migrated by hand", dep),
+				})
+			}
+		}
+	}
+	return out, report
+}
+
+// dependentsOf returns the sorted names of the services that depend on the
+// given service
+func (cf *ComposeFile) dependentsOf(service string) []string {
+	var dependents []string
+	for name, svc := range cf.Services {
+		if svc.DependsOn.Contains(service) {
+			dependents = append(dependents, name)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+func containsString(list []string, s string) bool {
+	for _, _s := range list {
+		if _s == s {
+			return true
+		}
+	}
+	return false
+}
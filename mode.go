@@ -0,0 +1,151 @@
+package containerutils
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	allServices        = "*"
+	defaultBindAddress = "127.0.0.1"
+)
+
+// Mode describes how a compose file is generated from the service registry.
+// Modes can be declared in the "modes" section of service-registry.json or
+// registered from code with RegisterMode
+type Mode struct {
+	Name string `json:"name"`
+	// Include lists the containers that are part of the compose file. Every
+	// containerized service is included when it is empty
+	Include []string `json:"include,omitempty"`
+	// Exclude lists containers that are left out, even when included
+	Exclude []string `json:"exclude,omitempty"`
+	// ExposePorts lists the containers whose ports are published on the
+	// host, where "*" stands for every container
+	ExposePorts []string `json:"exposePorts,omitempty"`
+	// BindAddress is the host address that published ports are bound to. It
+	// defaults to 127.0.0.1
+	BindAddress string `json:"bindAddress,omitempty"`
+	// Restart is the restart policy of services that do not declare their own
+	Restart string `json:"restart,omitempty"`
+	// Environment is merged into the environment of every service, after
+	// which ServiceEnvironment is merged into the matching containers
+	Environment        map[string]interface{}            `json:"environment,omitempty"`
+	ServiceEnvironment map[string]map[string]interface{} `json:"serviceEnvironment,omitempty"`
+	// Transformers lists registered transformers, by name, that run after
+	// the built-in ones when a compose file is generated in this mode
+	Transformers []string `json:"transformers,omitempty"`
+	// Local lists the services that run on the host rather than in a
+	// container, see HybridMode
+	Local []string `json:"local,omitempty"`
+	// Scheduler emits the scheduled tasks of the services, either as Ofelia
+	// labels ("ofelia") or as cron sidecars ("cron"). They are left out when
+	// it is empty
+	Scheduler string `json:"scheduler,omitempty"`
+}
+
+// The built-in modes
+var (
+	// DeveloperMode publishes the ports of every service
+	DeveloperMode = Mode{Name: "developer", ExposePorts: []string{allServices}}
+	// OrchestratorMode is used by the test orchestrator, so the only
+	// published port is the router's
+	OrchestratorMode = Mode{Name: "orchestrator", ExposePorts: []string{routerService}}
+	// ProductionMode publishes no ports. Use the "routerport" option of
+	// ComposeFile.Write to publish the router
+	ProductionMode = Mode{Name: "production"}
+)
+
+var (
+	modesMu sync.RWMutex
+	modes   = map[string]Mode{
+		DeveloperMode.Name:    DeveloperMode,
+		OrchestratorMode.Name: OrchestratorMode,
+		ProductionMode.Name:   ProductionMode,
+	}
+)
+
+// RegisterMode makes a mode available by name, replacing any mode that was
+// registered under the same name before
+func RegisterMode(m Mode) error {
+	if m.Name == "" {
+		return fmt.Errorf("Could not register mode: a mode needs a name")
+	}
+	modesMu.Lock()
+	defer modesMu.Unlock()
+	modes[m.Name] = m
+	return nil
+}
+
+// RegisteredModes returns the names of the modes that are registered from
+// code, in alphabetical order
+func RegisteredModes() []string {
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Mode looks a mode up by name. Modes declared in the registry take
+// precedence over modes that are registered from code
+func (rf *RegistryFile) Mode(name string) (Mode, error) {
+	for _, m := range rf.Modes {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+	if m, ok := modes[name]; ok {
+		return m, nil
+	}
+	return Mode{}, fmt.Errorf("Unknown compose mode '%v'", name)
+}
+
+// includes reports whether the container is part of compose files that are
+// generated in this mode
+func (m Mode) includes(container string) bool {
+	if containsString(m.Exclude, container) {
+		return false
+	}
+	return len(m.Include) == 0 || containsString(m.Include, container)
+}
+
+// exposesPorts reports whether the ports of the container are published
+func (m Mode) exposesPorts(container string) bool {
+	return containsString(m.ExposePorts, allServices) || containsString(m.ExposePorts, container)
+}
+
+func (m Mode) bindAddress() string {
+	if m.BindAddress == "" {
+		return defaultBindAddress
+	}
+	return m.BindAddress
+}
+
+// apply sets the restart policy and environment overlays of the mode on a
+// generated service
+func (m Mode) apply(s *Service) {
+	if s.Restart == "" {
+		s.Restart = m.Restart
+	}
+	overlays := []map[string]interface{}{m.Environment, m.ServiceEnvironment[s.Container]}
+	for _, overlay := range overlays {
+		if len(overlay) == 0 {
+			continue
+		}
+		env := make(map[string]interface{}, len(s.Environment)+len(overlay))
+		for k, v := range s.Environment {
+			env[k] = v
+		}
+		for k, v := range overlay {
+			env[k] = v
+		}
+		s.Environment = env
+	}
+}
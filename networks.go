@@ -0,0 +1,236 @@
+package containerutils
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultNetwork is the network that compose attaches services to when they
+// do not declare any networks
+const defaultNetwork = "default"
+
+// NetworkDefinition is a network that is declared in the "networks" section
+// of service-registry.json, e.g. "frontend", "backend" or "db"
+type NetworkDefinition struct {
+	Driver   string `json:"driver,omitempty"`
+	Internal bool   `json:"internal,omitempty"`
+	External bool   `json:"external,omitempty"`
+	// Name is the name of an external network, when it differs from the key
+	Name string `json:"name,omitempty"`
+	// Subnet is the IPAM subnet, which is required for static addresses
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// compose returns the top-level compose representation of the network
+func (nd NetworkDefinition) compose() map[string]interface{} {
+	m := make(map[string]interface{})
+	if nd.External {
+		m["external"] = true
+		if nd.Name != "" {
+			m["name"] = nd.Name
+		}
+		return m
+	}
+	if nd.Driver != "" {
+		m["driver"] = nd.Driver
+	}
+	if nd.Internal {
+		m["internal"] = true
+	}
+	if nd.Subnet != "" {
+		m["ipam"] = map[string]interface{}{
+			"config": []map[string]interface{}{{"subnet": nd.Subnet}},
+		}
+	}
+	return m
+}
+
+// ServiceNetwork attaches a service to a network, optionally with aliases
+// and a static IPv4 address
+type ServiceNetwork struct {
+	Name        string   `json:"name" yaml:"-"`
+	Aliases     []string `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	IPv4Address string   `json:"ipv4Address,omitempty" yaml:"ipv4_address,omitempty"`
+}
+
+func (sn ServiceNetwork) isShort() bool {
+	return len(sn.Aliases) == 0 && sn.IPv4Address == ""
+}
+
+// UnmarshalJSON accepts both a plain network name and an object
+func (sn *ServiceNetwork) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*sn = ServiceNetwork{Name: name}
+		return nil
+	}
+	type plain ServiceNetwork
+	return json.Unmarshal(b, (*plain)(sn))
+}
+
+// ServiceNetworks is a slice of ServiceNetwork - has methods on it
+type ServiceNetworks []ServiceNetwork
+
+// Contains checks if the service is attached to the given network
+func (sn ServiceNetworks) Contains(name string) bool {
+	for _, n := range sn {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// names returns the networks that the service is attached to, which is the
+// default network when none are declared
+func (sn ServiceNetworks) names() []string {
+	if len(sn) == 0 {
+		return []string{defaultNetwork}
+	}
+	names := make([]string, len(sn))
+	for i, n := range sn {
+		names[i] = n.Name
+	}
+	return names
+}
+
+// MarshalYAML writes a list of names when no network carries aliases or an
+// address, and the long mapping syntax otherwise
+func (sn ServiceNetworks) MarshalYAML() (interface{}, error) {
+	short := true
+	for _, n := range sn {
+		short = short && n.isShort()
+	}
+	if short {
+		return sn.names(), nil
+	}
+	m := &yaml.Node{Kind: yaml.MappingNode}
+	for _, n := range sn {
+		value := &yaml.Node{}
+		if n.isShort() {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		} else if err := value.Encode(n); err != nil {
+			return nil, err
+		}
+		m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: n.Name}, value)
+	}
+	return m, nil
+}
+
+// UnmarshalYAML accepts both the list and the mapping syntax
+func (sn *ServiceNetworks) UnmarshalYAML(value *yaml.Node) error {
+	*sn = nil
+	switch value.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := value.Decode(&names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			*sn = append(*sn, ServiceNetwork{Name: name})
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			n := ServiceNetwork{}
+			if err := value.Content[i+1].Decode(&n); err != nil {
+				return err
+			}
+			n.Name = value.Content[i].Value
+			*sn = append(*sn, n)
+		}
+	default:
+		return fmt.Errorf("networks must be a list or a mapping")
+	}
+	return nil
+}
+
+// applyNetworks declares the registry networks that are referenced by the
+// services of the compose file
+func (cf *ComposeFile) applyNetworks(definitions map[string]NetworkDefinition) {
+	for _, svc := range cf.Services {
+		for _, n := range svc.Networks {
+			def, ok := definitions[n.Name]
+			if !ok {
+				continue
+			}
+			if cf.Networks == nil {
+				cf.Networks = make(map[string]map[string]interface{})
+			}
+			cf.Networks[n.Name] = def.compose()
+		}
+	}
+}
+
+// adoptReferences declares the secrets and networks that the services refer
+// to, but that are missing at the top level, by copying them from another
+// compose file
+func (cf *ComposeFile) adoptReferences(from *ComposeFile) {
+	for _, svc := range cf.Services {
+		for _, ref := range svc.Secrets {
+			def, ok := from.Secrets[ref.Source]
+			if _, declared := cf.Secrets[ref.Source]; declared || !ok {
+				continue
+			}
+			if cf.Secrets == nil {
+				cf.Secrets = make(map[string]map[string]interface{})
+			}
+			cf.Secrets[ref.Source] = def
+		}
+		for _, n := range svc.Networks {
+			def, ok := from.Networks[n.Name]
+			if _, declared := cf.Networks[n.Name]; declared || !ok {
+				continue
+			}
+			if cf.Networks == nil {
+				cf.Networks = make(map[string]map[string]interface{})
+			}
+			cf.Networks[n.Name] = def
+		}
+	}
+}
+
+// CheckNetworks reports networks that are referenced by a service but not
+// declared at the top level, and every dependency that does not share at
+// least one network with the service that depends on it. The dependencies
+// are those of depends_on and the "dependencies" of the registry entries in
+// rf, which the compose file is generated from. Only depends_on is checked
+// when rf is nil
+func (cf *ComposeFile) CheckNetworks(rf *RegistryFile) []Warning {
+	var warnings []Warning
+	for _, name := range cf.serviceNames() {
+		svc := cf.Services[name]
+		for _, n := range svc.Networks {
+			if _, ok := cf.Networks[n.Name]; !ok && n.Name != defaultNetwork {
+				warnings = append(warnings, Warning{
+					Service: name,
+					Field:   "networks",
+					Message: fmt.Sprintf("the network '%v' is not declared", n.Name),
+				})
+			}
+		}
+		deps := cf.dependsOn(name)
+		if rf != nil {
+			deps = rf.dependenciesOf(name, cf)
+		}
+		for _, dep := range deps {
+			depSvc, ok := cf.Services[dep]
+			if !ok {
+				continue
+			}
+			shared := false
+			for _, n := range svc.Networks.names() {
+				shared = shared || containsString(depSvc.Networks.names(), n)
+			}
+			if !shared {
+				warnings = append(warnings, Warning{
+					Service: name,
+					Field:   "networks",
+					Message: fmt.Sprintf("shares no network with its dependency '%v'", dep),
+				})
+			}
+		}
+	}
+	return warnings
+}
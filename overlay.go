@@ -0,0 +1,187 @@
+package containerutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const baseLayer = "base"
+
+// RegistryOverlay holds the values of a single environment, keyed by service
+// name, that are deep-merged onto the base service registry. It is found in
+// the "overrides" section of service-registry.json and in environment
+// overlay files such as service-registry.production.json
+type RegistryOverlay struct {
+	Services map[string]ServiceOverride `json:"services,omitempty"`
+}
+
+// ServiceOverride holds the values of a service that differ per environment.
+// Unset fields leave the base value alone, while maps are merged key by key
+type ServiceOverride struct {
+	DefaultTag  *string                `json:"defaultTag,omitempty"`
+	Replicas    *int                   `json:"replicas,omitempty"`
+	Restart     *string                `json:"restart,omitempty"`
+	Port        []int                  `json:"port,omitempty"`
+	Environment map[string]interface{} `json:"environment,omitempty"`
+	Deploy      map[string]interface{} `json:"deploy,omitempty"`
+}
+
+// OverlayValue records the layer that a value of a service came from
+type OverlayValue struct {
+	Service string
+	Field   string
+	Layer   string
+}
+
+// OverlayReport shows which values were set by which overlay layer. Values
+// that are not listed come from the base registry
+type OverlayReport struct {
+	Layers []string
+	Values []OverlayValue
+}
+
+// Origin returns the layer that the given field of a service came from
+func (r OverlayReport) Origin(service, field string) string {
+	origin := baseLayer
+	for _, v := range r.Values {
+		if v.Service == service && v.Field == field {
+			origin = v.Layer
+		}
+	}
+	return origin
+}
+
+// String renders the report with one line per overridden value
+func (r OverlayReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "layers: %v\n", strings.Join(append([]string{baseLayer}, r.Layers...), " -> "))
+	for _, v := range r.Values {
+		fmt.Fprintf(&sb, "%v.%v: %v\n", v.Service, v.Field, v.Layer)
+	}
+	return sb.String()
+}
+
+// OverlayFilename returns the name of the overlay file of the given
+// environment, which lives next to the base registry file, e.g.
+// service-registry.production.json for service-registry.json
+func OverlayFilename(filename, environment string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + environment + ext
+}
+
+// ApplyOverlay deep-merges the overlay onto the registry services, recording
+// every value that it sets under the given layer name. Services are matched
+// on their name or container name
+func (rf *RegistryFile) ApplyOverlay(layer string, overlay RegistryOverlay, report *OverlayReport) error {
+	report.Layers = append(report.Layers, layer)
+	names := make([]string, 0, len(overlay.Services))
+	for name := range overlay.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		i := rf.serviceIndex(name)
+		if i < 0 {
+			return fmt.Errorf("Could not apply overlay '%v': service '%v' not found in the service registry", layer, name)
+		}
+		rf.Services[i].applyOverride(overlay.Services[name], func(field string) {
+			report.Values = append(report.Values, OverlayValue{Service: name, Field: field, Layer: layer})
+		})
+	}
+	return nil
+}
+
+// WithEnvironment applies the overrides of the given environment, first
+// from the "overrides" section and then from the overlay file next to
+// filename, when that file exists
+func (rf *RegistryFile) WithEnvironment(filename, environment string) (OverlayReport, error) {
+	report := OverlayReport{}
+	if environment == "" {
+		return report, nil
+	}
+	if overlay, ok := rf.Overrides[environment]; ok {
+		if err := rf.ApplyOverlay("overrides."+environment, overlay, &report); err != nil {
+			return report, err
+		}
+	}
+
+	overlayFile := OverlayFilename(filename, environment)
+	if !fileExists(overlayFile) {
+		return report, nil
+	}
+	file, err := ioutil.ReadFile(overlayFile)
+	if err != nil {
+		return report, fmt.Errorf("Could not read '%v': %v", overlayFile, err)
+	}
+	overlay := RegistryOverlay{}
+	if err = json.Unmarshal(file, &overlay); err != nil {
+		return report, fmt.Errorf("Could not read '%v' into a native json object: %v", overlayFile, err)
+	}
+	return report, rf.ApplyOverlay(overlayFile, overlay, &report)
+}
+
+func (rf *RegistryFile) serviceIndex(name string) int {
+	for i, svc := range rf.Services {
+		if svc.Name == name || svc.Container == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyOverride merges o onto the service, calling set with the name of
+// every field that it changes
+func (s *Service) applyOverride(o ServiceOverride, set func(field string)) {
+	if o.DefaultTag != nil {
+		s.DefaultTag = *o.DefaultTag
+		set("defaultTag")
+	}
+	if o.Restart != nil {
+		s.Restart = *o.Restart
+		set("restart")
+	}
+	if o.Port != nil {
+		s.Port = append([]int(nil), o.Port...)
+		set("port")
+	}
+	if len(o.Environment) > 0 {
+		s.Environment = deepMerge(s.Environment, o.Environment, "environment", set)
+	}
+	if len(o.Deploy) > 0 {
+		s.Deploy = deepMerge(s.Deploy, o.Deploy, "deploy", set)
+	}
+	if o.Replicas != nil {
+		s.Deploy = deepMerge(s.Deploy, map[string]interface{}{"replicas": *o.Replicas}, "deploy", set)
+	}
+}
+
+// deepMerge returns a copy of base with overlay merged into it. Nested maps
+// are merged recursively, while any other value replaces the base value
+func deepMerge(base, overlay map[string]interface{}, path string, set func(field string)) map[string]interface{} {
+	out := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		out[k] = v
+	}
+	keys := make([]string, 0, len(overlay))
+	for k := range overlay {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field := path + "." + k
+		nested, isMap := overlay[k].(map[string]interface{})
+		baseNested, baseIsMap := out[k].(map[string]interface{})
+		if isMap && baseIsMap {
+			out[k] = deepMerge(baseNested, nested, field, set)
+			continue
+		}
+		out[k] = overlay[k]
+		set(field)
+	}
+	return out
+}
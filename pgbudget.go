@@ -0,0 +1,235 @@
+package containerutils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// The values that are understood in the "maxPGConnectionSource" field of a
+// pgConnectionManager entry
+const (
+	PGConnectionSourceFixed    = "fixed"
+	PGConnectionSourceTextFile = "textFile"
+
+	defaultReservedPGConnections = 3
+	defaultPGBouncerPoolMode     = "transaction"
+)
+
+// PGBudgetConfig configures the Postgres connection budget calculation
+type PGBudgetConfig struct {
+	// MaxConnections is the max_connections setting of the Postgres server
+	MaxConnections int
+	// ReservedConnections is superuser_reserved_connections, which defaults to
+	// 3 when it is nil
+	ReservedConnections *int
+	// BaseDir is the directory that relative maxPGConnectionTextFile paths
+	// are resolved against
+	BaseDir string
+	// Services selects the services to budget for. All services that have a
+	// pgConnectionManager entry are used when it is empty
+	Services []string
+	// PoolMode is the pgbouncer pool_mode, which defaults to "transaction"
+	PoolMode string
+}
+
+// PGBudgetEntry is the resolved connection count of a single service
+type PGBudgetEntry struct {
+	Service     string
+	Source      string
+	Base        int
+	Multiplier  int
+	Connections int
+}
+
+// PGBudgetReport is the outcome of a connection budget calculation
+type PGBudgetReport struct {
+	Entries   []PGBudgetEntry
+	Total     int
+	Available int
+	PoolMode  string
+	Warnings  []Warning
+}
+
+// OverBudget reports whether the selected services together want more
+// connections than the Postgres server makes available
+func (r PGBudgetReport) OverBudget() bool {
+	return r.Total > r.Available
+}
+
+// String renders the report as a table
+func (r PGBudgetReport) String() string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSOURCE\tBASE\tMULTIPLIER\tCONNECTIONS")
+	for _, e := range r.Entries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", e.Service, e.Source, e.Base, e.Multiplier, e.Connections)
+	}
+	w.Flush()
+	fmt.Fprintf(&sb, "\ntotal %v of %v available connections", r.Total, r.Available)
+	if r.OverBudget() {
+		fmt.Fprintf(&sb, " (over budget by %v)", r.Total-r.Available)
+	}
+	sb.WriteString("\n")
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(&sb, "warning: %v\n", warning)
+	}
+	return sb.String()
+}
+
+// PGBouncerConfig returns the [pgbouncer] section of the configuration for
+// the dbpool service. Clients may open as many connections as the services
+// want in total, while the connections to Postgres itself are capped at the
+// number that is available on the server
+func (r PGBudgetReport) PGBouncerConfig() string {
+	poolSize := r.Total
+	if poolSize > r.Available {
+		poolSize = r.Available
+	}
+	var sb strings.Builder
+	sb.WriteString("[pgbouncer]\n")
+	fmt.Fprintf(&sb, "pool_mode = %v\n", r.PoolMode)
+	fmt.Fprintf(&sb, "max_client_conn = %v\n", r.Total)
+	fmt.Fprintf(&sb, "default_pool_size = %v\n", poolSize)
+	fmt.Fprintf(&sb, "max_db_connections = %v\n", r.Available)
+	return sb.String()
+}
+
+// PGConnectionBudget resolves the connection count of every selected service
+// from its pgConnectionManager entry and sums them against the configured
+// Postgres max_connections. Deposed services are left out, as they are no
+// longer part of any install
+func (rf *RegistryFile) PGConnectionBudget(cfg PGBudgetConfig) (PGBudgetReport, error) {
+	if cfg.MaxConnections <= 0 {
+		return PGBudgetReport{}, fmt.Errorf("Could not calculate connection budget: max_connections must be positive")
+	}
+	reserved := defaultReservedPGConnections
+	if cfg.ReservedConnections != nil {
+		reserved = *cfg.ReservedConnections
+	}
+	if reserved < 0 {
+		return PGBudgetReport{}, fmt.Errorf("Could not calculate connection budget: the reserved connections cannot be negative")
+	}
+	report := PGBudgetReport{
+		Available: cfg.MaxConnections - reserved,
+		PoolMode:  cfg.PoolMode,
+	}
+	if report.PoolMode == "" {
+		report.PoolMode = defaultPGBouncerPoolMode
+	}
+
+	selected := make(map[string]bool, len(cfg.Services))
+	for _, name := range cfg.Services {
+		selected[name] = false
+	}
+	for _, svc := range rf.activeServices() {
+		name := svc.serviceName()
+		if len(cfg.Services) > 0 {
+			if _, ok := selected[name]; !ok {
+				continue
+			}
+			selected[name] = true
+		}
+		if svc.PGConnectionManager == nil {
+			if len(cfg.Services) > 0 {
+				report.Warnings = append(report.Warnings, Warning{Service: name, Field: "pgConnectionManager", Message: "no connection manager entry, assuming 0 connections"})
+			}
+			continue
+		}
+		entry, err := svc.PGConnectionManager.resolve(cfg.BaseDir)
+		if err != nil {
+			return PGBudgetReport{}, fmt.Errorf("Could not resolve connections of '%v': %v", name, err)
+		}
+		entry.Service = name
+		report.Entries = append(report.Entries, entry)
+		report.Total += entry.Connections
+	}
+
+	// Every service needs at least one connection to Postgres, or the pool
+	// sizes of the dbpool would be meaningless
+	if report.Available < len(report.Entries) {
+		return PGBudgetReport{}, fmt.Errorf("Could not calculate connection budget: max_connections of %v leaves %v connections after the %v reserved ones, which is fewer than the %v services need at minimum", cfg.MaxConnections, report.Available, reserved, len(report.Entries))
+	}
+
+	for _, name := range cfg.Services {
+		if !selected[name] {
+			report.Warnings = append(report.Warnings, Warning{Service: name, Field: "services", Message: "not found in the service registry"})
+		}
+	}
+	if report.OverBudget() {
+		report.Warnings = append(report.Warnings, Warning{
+			Field:   "max_connections",
+			Message: fmt.Sprintf("the services want %v connections, but only %v are available", report.Total, report.Available),
+		})
+	}
+	return report, nil
+}
+
+// resolve evaluates the entry into a connection count
+func (m *ServicePGConnectionManager) resolve(baseDir string) (PGBudgetEntry, error) {
+	entry := PGBudgetEntry{Source: m.MaxPGConnectionSource, Multiplier: m.MaxPGConnectionMultiplier}
+	if entry.Multiplier == 0 {
+		entry.Multiplier = 1
+	}
+
+	switch m.MaxPGConnectionSource {
+	case PGConnectionSourceFixed, "":
+		entry.Base = m.MaxPGConnection
+	case PGConnectionSourceTextFile:
+		filename := m.MaxPGConnectionTextFile
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(baseDir, filename)
+		}
+		base, err := readKeyPhraseInt(filename, m.MaxPGConnectionKeyPhrase)
+		if err != nil {
+			return entry, err
+		}
+		entry.Base = base
+	default:
+		return entry, fmt.Errorf("unknown maxPGConnectionSource '%v'", m.MaxPGConnectionSource)
+	}
+
+	entry.Connections = entry.Base * entry.Multiplier
+	return entry, nil
+}
+
+// readKeyPhraseInt finds the first line of the file that contains the key
+// phrase and parses the integer that follows it, skipping separators such as
+// "=", ":" and quotes
+func readKeyPhraseInt(filename, keyPhrase string) (int, error) {
+	if keyPhrase == "" {
+		return 0, fmt.Errorf("no maxPGConnectionKeyPhrase is set for '%v'", filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, keyPhrase)
+		if i < 0 {
+			continue
+		}
+		rest := strings.TrimLeft(line[i+len(keyPhrase):], " \t=:\"'")
+		end := 0
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(rest[:end])
+		if err != nil {
+			return 0, fmt.Errorf("'%v' in '%v' is not followed by a number", keyPhrase, filename)
+		}
+		return n, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("'%v' not found in '%v'", keyPhrase, filename)
+}
@@ -0,0 +1,221 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const composeVersion = "3.2"
+
+// Transformer is a single step of generating a compose file from the service
+// registry. Transformers run in order and modify the compose file in place
+type Transformer interface {
+	Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error
+}
+
+// TransformerFunc lets an ordinary function be used as a Transformer
+type TransformerFunc func(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error
+
+// Transform calls f
+func (f TransformerFunc) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	return f(ctx, cf, rf)
+}
+
+// Pipeline is an ordered list of transformers
+type Pipeline []Transformer
+
+// Run applies every transformer of the pipeline to the compose file, stopping
+// at the first error or when the context is done. The compose services share
+// their slices and maps with rf, so transformers may change it; Generate
+// runs the pipeline on a copy of the registry instead
+func (p Pipeline) Run(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	for _, t := range p {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := t.Transform(ctx, cf, rf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]Transformer{}
+)
+
+// RegisterTransformer makes a transformer available by name, so that modes
+// can list it in their "transformers". Any transformer that was registered
+// under the same name before is replaced
+func RegisterTransformer(name string, t Transformer) error {
+	if name == "" || t == nil {
+		return fmt.Errorf("Could not register transformer: a transformer needs a name")
+	}
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers[name] = t
+	return nil
+}
+
+// RegisteredTransformers returns the names of the registered transformers, in
+// alphabetical order
+func RegisteredTransformers() []string {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	names := make([]string, 0, len(transformers))
+	for name := range transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupTransformer(name string) (Transformer, bool) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	t, ok := transformers[name]
+	return t, ok
+}
+
+// GenerateConfig holds everything that a compose file is generated from,
+// besides the registry itself
+type GenerateConfig struct {
+	Tag        string
+	Mode       Mode
+	RouterPort int
+	// Options are the options of ComposeFile.Write. They are applied last,
+	// after every other transformer, when set
+	Options map[string]interface{}
+	// Filename is the compose file that is about to be written, which is
+	// where the HTTPS options look for certificates
+	Filename string
+	// Transformers run after the transformers of the mode
+	Transformers []Transformer
+}
+
+// ServicesTransformer adds the containerized services of the registry that
+// have not been deposed and are included by the mode, with their image set
+// for the tag and their ports published according to the mode. The services
+// are shallow copies of those of the registry
+type ServicesTransformer struct {
+	Tag        string
+	Mode       Mode
+	RouterPort int
+}
+
+// Transform implements Transformer
+func (t ServicesTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	if cf.Services == nil {
+		cf.Services = make(map[string]*Service, len(rf.Services))
+	}
+	for i := range rf.Services {
+		svc := &rf.Services[i]
+		if svc.Container == "" || !t.Mode.includes(svc.Container) || rf.IsDeposed(svc.Container) || rf.IsDeposed(svc.Name) {
+			continue
+		}
+		_svc := svc.toDockerCompose(t.Mode, t.RouterPort)
+		_svc.setDockerComposeImage(t.Tag)
+		cf.Services[svc.Container] = _svc
+	}
+	return nil
+}
+
+// WaitForPostgresTransformer makes the services that depend on the db wait
+// for postgres before they start
+type WaitForPostgresTransformer struct{}
+
+// Transform implements Transformer
+func (WaitForPostgresTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	for _, svc := range cf.Services {
+		if svc.DependsOnDB() {
+			svc.waitForPostgres()
+		}
+	}
+	return nil
+}
+
+// RegistryTransformer strips the dependencies on deposed services, declares
+// the secrets and networks that the services refer to and emits the service
+// groups as compose profiles
+type RegistryTransformer struct{}
+
+// Transform implements Transformer
+func (RegistryTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	for _, svc := range cf.Services {
+		for _, deposed := range rf.DeposedServices {
+			if svc.DependsOn.Contains(deposed) {
+				svc.DependsOn.Remove(deposed)
+			}
+		}
+	}
+	cf.applySecrets(rf.Secrets)
+	cf.applyNetworks(rf.Networks)
+	cf.applyProfiles(rf)
+	return nil
+}
+
+// OptionsTransformer applies the options of ComposeFile.Write
+type OptionsTransformer struct {
+	Options  map[string]interface{}
+	Filename string
+}
+
+// Transform implements Transformer
+func (t OptionsTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	return cf.applyWriteOptions(parseWriteOptions(t.Options), t.Filename)
+}
+
+// builtinPipeline returns the transformers that every compose file is
+// generated with
+func builtinPipeline(cfg GenerateConfig) Pipeline {
+	p := Pipeline{
+		ServicesTransformer{Tag: cfg.Tag, Mode: cfg.Mode, RouterPort: cfg.RouterPort},
+		WaitForPostgresTransformer{},
+		JobTransformer{},
+	}
+	if len(cfg.Mode.Local) > 0 {
+		p = append(p, HybridTransformer{Local: cfg.Mode.Local})
+	}
+	if cfg.Mode.Scheduler != "" {
+		p = append(p, ScheduleTransformer{Scheduler: cfg.Mode.Scheduler})
+	}
+	return append(p, RegistryTransformer{})
+}
+
+// Pipeline returns the transformers that Generate runs: the built-in ones,
+// followed by the registered transformers that the mode lists, the
+// transformers of the config and finally the options of ComposeFile.Write
+func (rf *RegistryFile) Pipeline(cfg GenerateConfig) (Pipeline, error) {
+	p := builtinPipeline(cfg)
+	for _, name := range cfg.Mode.Transformers {
+		t, ok := lookupTransformer(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown transformer '%v' in compose mode '%v'", name, cfg.Mode.Name)
+		}
+		p = append(p, t)
+	}
+	p = append(p, cfg.Transformers...)
+	if cfg.Options != nil {
+		p = append(p, OptionsTransformer{Options: cfg.Options, Filename: cfg.Filename})
+	}
+	return p, nil
+}
+
+// Generate transforms the registry into a compose file by running its
+// pipeline. The transformers are handed a copy of the registry, so custom
+// transformers cannot change it
+func (rf *RegistryFile) Generate(ctx context.Context, cfg GenerateConfig) (ComposeFile, error) {
+	cf := ComposeFile{Version: composeVersion, Services: make(map[string]*Service, len(rf.Services))}
+	p, err := rf.Pipeline(cfg)
+	if err != nil {
+		return cf, err
+	}
+	_rf := rf.Clone()
+	if err := p.Run(ctx, &cf, &_rf); err != nil {
+		return cf, fmt.Errorf("Could not generate compose file: %v", err)
+	}
+	return cf, nil
+}
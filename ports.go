@@ -0,0 +1,196 @@
+package containerutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+)
+
+const (
+	maxHostPort = 65535
+	// projects are spread over projectSlots offsets of projectOffsetStep
+	// ports each, e.g. a project may land on 8080 -> 8380
+	projectOffsetStep = 100
+	projectSlots      = 90
+)
+
+// PortAllocator assigns the host ports of a compose file, so that several
+// stacks of the same registry can run side by side on one host
+type PortAllocator struct {
+	// Offset is added to every published host port
+	Offset int
+	// Project derives the offset from a project name when Offset is 0, so
+	// that the same project always lands on the same ports. Only projectSlots
+	// offsets exist, so two projects may hash onto the same one; the ports
+	// of a derived offset are therefore always probed
+	Project string
+	// Probe moves a host port up until it finds one that is free on this
+	// host, by briefly listening on it
+	Probe bool
+	// Ephemeral lets the operating system pick a free host port for every
+	// published port, ignoring the registry port, Offset and Project
+	Ephemeral bool
+}
+
+// PortBinding records where a published container port landed on the host
+type PortBinding struct {
+	Service       string `json:"service"`
+	ContainerPort int    `json:"containerPort"`
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      int    `json:"hostPort"`
+}
+
+// Address returns the address that the port is reachable on from the host
+func (pb PortBinding) Address() string {
+	ip := pb.HostIP
+	if ip == "" || ip == "0.0.0.0" {
+		ip = defaultBindAddress
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(pb.HostPort))
+}
+
+// PortMap lists the port bindings of a compose file by service and
+// container port
+type PortMap []PortBinding
+
+// HostPort returns the host port that the container port of the service is
+// published on
+func (pm PortMap) HostPort(service string, containerPort int) (int, bool) {
+	for _, pb := range pm {
+		if pb.Service == service && pb.ContainerPort == containerPort {
+			return pb.HostPort, true
+		}
+	}
+	return 0, false
+}
+
+// Address returns the host address that the container port of the service
+// is reachable on, e.g. "127.0.0.1:8180"
+func (pm PortMap) Address(service string, containerPort int) (string, bool) {
+	for _, pb := range pm {
+		if pb.Service == service && pb.ContainerPort == containerPort {
+			return pb.Address(), true
+		}
+	}
+	return "", false
+}
+
+// Write writes the port map as JSON, for test harnesses that run in another
+// process
+func (pm PortMap) Write(filename string) error {
+	b, err := json.MarshalIndent(pm, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Could not marshal JSON: %v", err)
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// probe reports whether host ports are checked for being free, which is
+// the case for a derived offset, as it may collide with another project's
+func (pa PortAllocator) probe() bool {
+	return pa.Probe || (pa.Offset == 0 && pa.Project != "")
+}
+
+// offset returns the configured offset, or the one derived from the project
+func (pa PortAllocator) offset() int {
+	if pa.Offset != 0 || pa.Project == "" {
+		return pa.Offset
+	}
+	h := fnv.New32a()
+	h.Write([]byte(pa.Project))
+	return int(h.Sum32()%projectSlots+1) * projectOffsetStep
+}
+
+// Allocate rewrites the published host ports of every service, the router
+// and db included, and returns where each one landed. Ports that only name
+// the container port are left to docker and are not part of the map
+func (pa PortAllocator) Allocate(cf *ComposeFile) (PortMap, error) {
+	offset, probe := pa.offset(), pa.probe()
+	used := make(map[int]bool)
+	pm := PortMap{}
+	for _, name := range cf.serviceNames() {
+		svc := cf.Services[name]
+		ports := make(Attributes, 0, len(svc.DockerComposePort))
+		for _, port := range svc.DockerComposePort {
+			ip, host, inner, err := parsePortMapping(port.String())
+			if err != nil {
+				return nil, fmt.Errorf("Could not allocate the ports of '%v': %v", name, err)
+			}
+			if host == "" {
+				ports = append(ports, port)
+				continue
+			}
+			hostPort, err := strconv.Atoi(host)
+			if err != nil {
+				return nil, fmt.Errorf("Could not allocate the ports of '%v': '%v' is not a port", name, host)
+			}
+			containerPort, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("Could not allocate the ports of '%v': '%v' is not a port", name, inner)
+			}
+
+			if pa.Ephemeral {
+				if hostPort, err = ephemeralPort(ip, used); err != nil {
+					return nil, fmt.Errorf("Could not allocate the ports of '%v': %v", name, err)
+				}
+			} else {
+				hostPort += offset
+				for used[hostPort] || (probe && !portIsFree(ip, hostPort)) {
+					hostPort++
+				}
+			}
+			if hostPort > maxHostPort {
+				return nil, fmt.Errorf("Could not allocate the ports of '%v': no free host port for %v", name, port)
+			}
+			used[hostPort] = true
+
+			mapping := fmt.Sprintf("%v:%v", hostPort, inner)
+			if ip != "" {
+				mapping = ip + ":" + mapping
+			}
+			ports = append(ports, Attribute(mapping))
+			pm = append(pm, PortBinding{Service: name, ContainerPort: containerPort, HostIP: ip, HostPort: hostPort})
+		}
+		svc.DockerComposePort = ports
+	}
+	sort.SliceStable(pm, func(i, j int) bool {
+		if pm[i].Service != pm[j].Service {
+			return pm[i].Service < pm[j].Service
+		}
+		return pm[i].ContainerPort < pm[j].ContainerPort
+	})
+	return pm, nil
+}
+
+// ephemeralPort asks the operating system for a free port that has not been
+// handed out yet
+func ephemeralPort(ip string, used map[int]bool) (int, error) {
+	for {
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if !used[port] {
+			return port, nil
+		}
+	}
+}
+
+// portIsFree reports whether nothing is listening on the host port
+func portIsFree(ip string, port int) bool {
+	if port > maxHostPort {
+		return true
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,96 @@
+package containerutils
+
+import (
+	"fmt"
+)
+
+// Groups returns the service groups that are used in the registry, in
+// alphabetical order
+func (rf *RegistryFile) Groups() []string {
+	seen := make(map[string]bool)
+	for _, svc := range rf.activeServices() {
+		for _, g := range svc.Groups {
+			seen[g] = true
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// profiles returns the compose profiles of a service, which are its groups.
+// Services that belong to one of the default groups get no profiles, so
+// that "docker compose up" always starts them
+func (rf *RegistryFile) profiles(s Service) Attributes {
+	var profiles Attributes
+	for _, g := range s.Groups {
+		if containsString(rf.DefaultGroups, g) {
+			return nil
+		}
+		if !profiles.Contains(g) {
+			profiles = profiles.AndString(g)
+		}
+	}
+	return profiles
+}
+
+// applyProfiles sets the compose profiles of every service from the groups
+// that it carries over from its registry entry
+func (cf *ComposeFile) applyProfiles(rf *RegistryFile) {
+	for _, svc := range cf.Services {
+		if len(svc.Groups) == 0 {
+			continue
+		}
+		svc.Profiles = rf.profiles(*svc)
+	}
+}
+
+// FilterByProfile returns the services that docker compose would start with
+// the given profiles enabled: those without profiles and those in any of
+// the profiles, along with the services they depend on. The profiles of the
+// returned services are cleared, so a plain "docker compose up" starts the
+// whole selection
+func (cf *ComposeFile) FilterByProfile(profiles ...string) (ComposeFile, error) {
+	out := ComposeFile{
+		Version:  cf.Version,
+		Name:     cf.Name,
+		Services: make(map[string]*Service),
+	}
+	known := make(map[string]bool)
+	for name, svc := range cf.Services {
+		enabled := len(svc.Profiles) == 0
+		for _, p := range svc.Profiles {
+			known[p.String()] = true
+			enabled = enabled || containsString(profiles, p.String())
+		}
+		if enabled {
+			out.Services[name] = svc
+		}
+	}
+	for _, p := range profiles {
+		if !known[p] {
+			return ComposeFile{}, fmt.Errorf("Unknown profile '%v'", p)
+		}
+	}
+	if _, err := resolveDependencies(&out, cf, cf.dependsOn, nil); err != nil {
+		return ComposeFile{}, err
+	}
+
+	for name, svc := range out.Services {
+		_svc := *svc
+		_svc.Profiles = nil
+		out.Services[name] = &_svc
+	}
+	out.adoptReferences(cf)
+	return out, nil
+}
+
+// Profiles returns the compose profiles that are used in the compose file,
+// in alphabetical order
+func (cf *ComposeFile) Profiles() []string {
+	seen := make(map[string]bool)
+	for _, svc := range cf.Services {
+		for _, p := range svc.Profiles {
+			seen[p.String()] = true
+		}
+	}
+	return sortedKeys(seen)
+}
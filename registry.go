@@ -1,10 +1,10 @@
 package containerutils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-
-	mapper "github.com/PeteProgrammer/go-automapper"
+	"io/ioutil"
 )
 
 // RegistryFile is an abstraction of the service-registry.json file
@@ -12,20 +12,34 @@ type RegistryFile struct {
 	Services          Services `json:"services,omitempty"`
 	DeposedServices   []string `json:"deposedServices,omitempty"`
 	UnmanagedServices []string `json:"unmanagedServices,omitempty"`
+	Modes             []Mode   `json:"modes,omitempty"`
+	// DefaultGroups are the service groups that always start, so they are
+	// not emitted as compose profiles
+	DefaultGroups []string `json:"defaultGroups,omitempty"`
+	// Secrets declares the secrets that services refer to, keyed by name
+	Secrets map[string]SecretDefinition `json:"secrets,omitempty"`
+	// Networks declares the networks that services attach to, keyed by name
+	Networks map[string]NetworkDefinition `json:"networks,omitempty"`
+	// Overrides holds per-environment values, keyed by environment name
+	Overrides map[string]RegistryOverlay `json:"overrides,omitempty"`
 }
 
-func (rf *RegistryFile) clone() RegistryFile {
-	_rf := RegistryFile{}
-	copy(_rf.Services, rf.Services)
-	copy(_rf.DeposedServices, rf.DeposedServices)
-	copy(_rf.UnmanagedServices, rf.UnmanagedServices)
-	return *rf
+// ReadFromFile reads the given service-registry.json into the RegistryFile
+func (rf *RegistryFile) ReadFromFile(filename string) error {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("Could not read '%v': %v", filename, err)
+	}
+	if err = json.Unmarshal(file, rf); err != nil {
+		return fmt.Errorf("Could not read '%v' into a native json object: %v", filename, err)
+	}
+	return rf.validateSchedules()
 }
 
 func (rf *RegistryFile) filterExcludedServices() *RegistryFile {
-	_rf := rf.clone()
+	_rf := rf.Clone()
 	_services := Services{}
-	for _, service := range rf.Services {
+	for _, service := range _rf.Services {
 		if !service.ExcludeFromServiceRegistry {
 			_services.Append(service)
 		}
@@ -48,8 +62,7 @@ func (s *Services) ToSliceKind() []Service {
 
 // Append appends Service s1 to the services object
 func (s *Services) Append(s1 Service) {
-	_s := Services(append(s.ToSliceKind(), s1))
-	s = &_s
+	*s = append(s.ToSliceKind(), s1)
 }
 
 // Service is an abstraction a service in the service-registry.json file
@@ -59,9 +72,9 @@ func (s *Services) Append(s1 Service) {
 // https://github.com/compose-spec/compose-spec/blob/master/spec.md#services-top-level-element
 type Service struct {
 	Name                       string                      `json:"name,omitempty" yaml:"-"`
-	Image                      string                      `json:"-" yaml:"image"`
+	Image                      string                      `json:"-" yaml:"image,omitempty"`
 	Container                  string                      `json:"container,omitempty" yaml:"-"`
-	RepoName                   string                      `json:"-" yaml:"-"`
+	RepoName                   string                      `json:"repoName,omitempty" yaml:"-"`
 	Port                       []int                       `json:"port,omitempty" yaml:"-"`
 	DockerComposePort          Attributes                  `json:"-" yaml:"ports,omitempty"`
 	Port80InDocker             bool                        `json:"port80InDocker,omitempty" yaml:"-"`
@@ -72,11 +85,15 @@ type Service struct {
 	HasPing                    bool                        `json:"hasPing,omitempty" yaml:"-"`
 	InstallType                string                      `json:"installType,omitempty" yaml:"-"`
 	BinPath                    string                      `json:"binPath,omitempty" yaml:"-"`
+	Job                        bool                        `json:"job,omitempty" yaml:"-"`
+	Schedule                   []ScheduledTask             `json:"schedule,omitempty" yaml:"-"`
 	Command                    string                      `json:"-" yaml:"command,omitempty"`
 	CommandKeyPhrase           string                      `json:"commandKeyPhrase,omitempty" yaml:"-"`
 	PGConnectionManager        *ServicePGConnectionManager `json:"pgConnectionManager,omitempty" yaml:"-"`
 	Dependencies               []string                    `json:"dependencies,omitempty" yaml:"-"`
+	Groups                     []string                    `json:"groups,omitempty" yaml:"-"`
 	DependsOn                  Attributes                  `json:"-" yaml:"depends_on,omitempty"`
+	DependsOnCondition         map[string]string           `json:"-" yaml:"-"`
 	Logs                       []ServiceLogs               `json:"logs,omitempty" yaml:"-"`
 	IsExclusivelyLinux         bool                        `json:"isExclusivelyLinux,omitempty" yaml:"-"`
 	DefaultTag                 string                      `json:"defaultTag,omitempty" yaml:"-"`
@@ -106,53 +123,57 @@ type Service struct {
 	Healthcheck                map[string]interface{}      `json:"-" yaml:"healthcheck,omitempty"`
 	Hostname                   string                      `json:"-" yaml:"hostname,omitempty"`
 	Init                       bool                        `json:"-" yaml:"init,omitempty"`
+	Labels                     map[string]string           `json:"-" yaml:"labels,omitempty"`
 	Links                      Attributes                  `json:"-" yaml:"links,omitempty"`
 	Logging                    map[string]interface{}      `json:"-" yaml:"logging,omitempty"`
 	NetworkMode                string                      `json:"-" yaml:"network_mode,omitempty"`
-	Networks                   Attributes                  `json:"-" yaml:"networks,omitempty"`
+	Networks                   ServiceNetworks             `json:"networks,omitempty" yaml:"networks,omitempty"`
 	Profiles                   Attributes                  `json:"-" yaml:"profiles,omitempty"`
 	PullPolicy                 string                      `json:"-" yaml:"pull_policy,omitempty"`
-	Secrets                    Attributes                  `json:"-" yaml:"secrets,omitempty"`
+	Secrets                    ServiceSecrets              `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	SecurityOpt                Attributes                  `json:"-" yaml:"security_opt,omitempty"`
 	ShmSize                    string                      `json:"-" yaml:"shm_size,omitempty"`
 	StopGracePeriod            string                      `json:"-" yaml:"stop_grace_period,omitempty"`
 	Sysctls                    Attributes                  `json:"-" yaml:"sysctls,omitempty"`
 	ULimits                    map[string]interface{}      `json:"-" yaml:"ulimits,omitempty"`
+	WorkingDir                 string                      `json:"-" yaml:"working_dir,omitempty"`
 }
 
-func (s *Service) clone() {
-
-}
-
-func (s *Service) transformPort(routerPort int) {
+func (s *Service) transformPort(routerPort int, bindAddress string) {
 	if s.DockerComposePort != nil {
 		return
 	}
-	s.DockerComposePort = s.GetDockerComposePort(routerPort)
+	s.DockerComposePort = s.dockerComposePort(routerPort, bindAddress)
 }
 
 // toDockerCompose transforms the Service object into something that
-// would be suited for a docker-compose.yml
-func (s *Service) toDockerCompose(mode composeMode, routerPort int) *Service {
-	_s := &Service{}
-	mapper.Map(s, _s)
-	// We expose the router ports for all of our test orchestrator images, as
-	// well as potentially doing so in the case of production machines
-	if mode == developerCompose || mode == orchestratorCompose && s.Container == "router" {
-		s.transformPort(routerPort)
+// would be suited for a docker-compose.yml. The result is a shallow copy,
+// which shares its slices and maps with the service
+func (s *Service) toDockerCompose(mode Mode, routerPort int) *Service {
+	_s := *s
+	// The mode decides whose ports are published, e.g. only the router's
+	// for our test orchestrator images
+	if mode.exposesPorts(_s.Container) {
+		_s.transformPort(routerPort, mode.bindAddress())
 	}
-	return _s
+	mode.apply(&_s)
+	return &_s
 }
 
 // GetDockerComposePort returns the "port" entry for the docker-compose
 // service entry
 func (s *Service) GetDockerComposePort(routerPort int) Attributes {
+	return s.dockerComposePort(routerPort, defaultBindAddress)
+}
+
+func (s *Service) dockerComposePort(routerPort int, bindAddress string) Attributes {
 	_p := s.Port
-	if s.Container == "router" && routerPort != 0 {
+	if s.Container == routerService && routerPort != 0 {
 		_p = []int{routerPort}
 	}
 	attr := Attributes{}
 	for _, port := range _p {
-		_str := fmt.Sprintf("127.0.0.1:%v:%v", port, s.pickInnerPort())
+		_str := fmt.Sprintf("%v:%v:%v", bindAddress, port, s.pickInnerPort(port))
 		attr = attr.AndString(_str)
 	}
 	return attr
@@ -173,42 +194,52 @@ func (s Services) containerized() Services {
 
 // GetServicesAsYML returns a YML map of the services and their subsisting
 // information
-func (s *Services) GetServicesAsYML(tag string, mode composeMode, routerPort int) map[string]*Service {
-	_s := make(map[string]*Service)
-	for _, svc := range s.containerized() {
-		_svc := svc.SetDockerComposeImage(tag).toDockerCompose(mode, routerPort)
-		if svc.DependsOnDB() {
-			_svc = _svc.waitForPostgres()
-		}
-		_s[svc.Container] = _svc
+func (s *Services) GetServicesAsYML(tag string, mode Mode, routerPort int) (map[string]*Service, error) {
+	_c, err := s.ToDockerCompose(tag, mode, routerPort)
+	if err != nil {
+		return nil, err
 	}
-	return _s
+	return _c.Services, nil
 }
 
 // ToDockerCompose performs a set of transformations on the services
 // to turn them into a form that can be used for docker-compose.yml
-func (s Services) ToDockerCompose(tag string, mode composeMode, routerPort int) ComposeFile {
-	_s := s.GetServicesAsYML(tag, mode, routerPort)
-	_c := ComposeFile{}
-	_c.Version = "3.2"
-	_c.Services = _s
-	return _c
+func (s Services) ToDockerCompose(tag string, mode Mode, routerPort int) (ComposeFile, error) {
+	_c := ComposeFile{Version: composeVersion, Services: make(map[string]*Service)}
+	_rf := &RegistryFile{Services: s.Clone()}
+	p := Pipeline{
+		ServicesTransformer{Tag: tag, Mode: mode, RouterPort: routerPort},
+		WaitForPostgresTransformer{},
+	}
+	if err := p.Run(context.Background(), &_c, _rf); err != nil {
+		return ComposeFile{}, fmt.Errorf("Could not generate compose file: %v", err)
+	}
+	return _c, nil
+}
+
+// serviceName returns the registry name of the service, falling back to its
+// container name
+func (s Service) serviceName() string {
+	if s.Name == "" {
+		return s.Container
+	}
+	return s.Name
 }
 
 // DependsOnDB establishes whether a service depends on the db or dbpool docker image.
 func (s Service) DependsOnDB() bool {
-	return s.DependsOn.Contains("db") || s.DependsOn.Contains("dbpool")
+	return s.DependsOn.Contains(dbService) || s.DependsOn.Contains(dbPoolService)
 }
 
-func (s *Service) pickInnerPort() string {
+func (s *Service) pickInnerPort(port int) string {
 	if s.Port80InDocker {
 		return "80"
 	}
-	return fmt.Sprintf("%v", s.Port)
+	return fmt.Sprintf("%v", port)
 }
 
 func (s *Service) waitForPostgres() *Service {
-	s.Command = "wait-for-nc.sh config:80 -- wait-for-postgres.sh db /opt/" + pickBinaryName(s.Container)
+	s.Command = waitForPostgresCommand + " /opt/" + pickBinaryName(s.Container)
 	return s
 }
 
@@ -228,8 +259,13 @@ func pickBinaryName(serviceName string) string {
 // method, and the "DefaultTag" is unspecified, the tag "latest" will instead
 // be passed on to the tag
 func (s Service) SetDockerComposeImage(desiredTag string) *Service {
+	s.setDockerComposeImage(desiredTag)
+	return &s
+}
+
+func (s *Service) setDockerComposeImage(desiredTag string) {
 	if s.Image != "" || s.IsExternalImage {
-		return &s
+		return
 	}
 
 	_t := desiredTag
@@ -240,8 +276,7 @@ func (s Service) SetDockerComposeImage(desiredTag string) *Service {
 		_t = s.DefaultTag
 	}
 
-	s.Image = fmt.Sprintf("imqs/%v:%v", s.Container, _t)
-	return &s
+	s.Image = fmt.Sprintf("%v%v:%v", inhouseImagePrefix, s.Container, _t)
 }
 
 func (rf *RegistryFile) jsonBytes() ([]byte, error) {
@@ -0,0 +1,244 @@
+package containerutils
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Route maps the URL prefix of a service onto the container that serves it
+type Route struct {
+	Service   string
+	Prefix    string
+	Container string
+	Port      string
+	// Address overrides the upstream of the route, e.g. for a service that
+	// runs on the host rather than in a container
+	Address string
+}
+
+// Upstream returns the address that the router proxies the route to
+func (r Route) Upstream() string {
+	if r.Address != "" {
+		return r.Address
+	}
+	return r.Container + ":" + r.Port
+}
+
+// RouteConfig configures the generated router configuration
+type RouteConfig struct {
+	// ServerName is the host name that the router answers to. It defaults
+	// to "localhost"
+	ServerName string
+	// StripPrefix removes the URL prefix of the route before the request is
+	// passed on to the service
+	StripPrefix bool
+	// HTTPS terminates TLS at the router using CertFile and KeyFile, which
+	// are paths inside the router container. It is ignored unless both files
+	// are set, as none of the routers can serve HTTPS without them
+	HTTPS    bool
+	CertFile string
+	KeyFile  string
+	// RedirectHTTP redirects plain HTTP requests to HTTPS
+	RedirectHTTP bool
+}
+
+// RouteConfigFromOptions returns a RouteConfig that matches the options map
+// accepted by ComposeFile.Write, so that the router is configured for HTTPS
+// whenever the "https" option is set along with a certificate. The
+// certificate paths point at the secrets that Write mounts into the router
+func RouteConfigFromOptions(options map[string]interface{}) RouteConfig {
+	wo := parseWriteOptions(options)
+	if !wo.https || !wo.tls.hasCertificate() {
+		return RouteConfig{}
+	}
+	cfg := RouteConfig{HTTPS: true, RedirectHTTP: wo.tls.RedirectHTTP}
+	cfg.CertFile, cfg.KeyFile = RouterCertificatePaths()
+	return cfg
+}
+
+// https reports whether the router terminates TLS
+func (cfg RouteConfig) https() bool {
+	return cfg.HTTPS && cfg.CertFile != "" && cfg.KeyFile != ""
+}
+
+func (cfg RouteConfig) serverName() string {
+	if cfg.ServerName == "" {
+		return "localhost"
+	}
+	return cfg.ServerName
+}
+
+// Routes returns the routes of the containerized, non-deposed services that
+// have a url, ordered from the longest prefix to the shortest so that
+// first-match routers pick the most specific route
+func (rf *RegistryFile) Routes() []Route {
+	var routes []Route
+	for _, svc := range rf.activeServices().containerized() {
+		if svc.URL == "" || svc.Container == routerService || len(svc.Port) == 0 {
+			continue
+		}
+		routes = append(routes, Route{
+			Service:   svc.serviceName(),
+			Prefix:    routePrefix(svc.URL),
+			Container: svc.Container,
+			Port:      svc.pickInnerPort(svc.Port[0]),
+		})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if len(routes[i].Prefix) != len(routes[j].Prefix) {
+			return len(routes[i].Prefix) > len(routes[j].Prefix)
+		}
+		return routes[i].Prefix < routes[j].Prefix
+	})
+	return routes
+}
+
+// routePrefix turns the url of a registry service into a path prefix. Both
+// absolute urls and bare paths are accepted
+func routePrefix(u string) string {
+	p := u
+	if parsed, err := url.Parse(u); err == nil && parsed.Scheme != "" {
+		p = parsed.Path
+	}
+	return "/" + strings.Trim(p, "/")
+}
+
+// NginxConfig generates an nginx server block that proxies each route to its
+// container
+func NginxConfig(routes []Route, cfg RouteConfig) string {
+	var sb strings.Builder
+	redirect := cfg.https() && cfg.RedirectHTTP
+	if redirect {
+		sb.WriteString("server {\n")
+		sb.WriteString("    listen 80;\n")
+		fmt.Fprintf(&sb, "    server_name %v;\n", cfg.serverName())
+		sb.WriteString("    return 301 https://$host$request_uri;\n")
+		sb.WriteString("}\n\n")
+	}
+	sb.WriteString("server {\n")
+	if !redirect {
+		sb.WriteString("    listen 80;\n")
+	}
+	if cfg.https() {
+		sb.WriteString("    listen 443 ssl;\n")
+		fmt.Fprintf(&sb, "    ssl_certificate %v;\n", cfg.CertFile)
+		fmt.Fprintf(&sb, "    ssl_certificate_key %v;\n", cfg.KeyFile)
+	}
+	fmt.Fprintf(&sb, "    server_name %v;\n", cfg.serverName())
+	for _, r := range routes {
+		location, target := r.Prefix, "http://"+r.Upstream()
+		if r.Prefix != "/" {
+			location += "/"
+		}
+		if cfg.StripPrefix {
+			target += "/"
+		}
+		fmt.Fprintf(&sb, "\n    location %v {\n", location)
+		fmt.Fprintf(&sb, "        proxy_pass %v;\n", target)
+		sb.WriteString("        proxy_set_header Host $host;\n")
+		sb.WriteString("        proxy_set_header X-Real-IP $remote_addr;\n")
+		sb.WriteString("        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n")
+		sb.WriteString("        proxy_set_header X-Forwarded-Proto $scheme;\n")
+		sb.WriteString("    }\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// CaddyConfig generates a Caddyfile that proxies each route to its container
+func CaddyConfig(routes []Route, cfg RouteConfig) string {
+	var sb strings.Builder
+	if cfg.https() {
+		fmt.Fprintf(&sb, "https://%v {\n", cfg.serverName())
+		fmt.Fprintf(&sb, "\ttls %v %v\n", cfg.CertFile, cfg.KeyFile)
+	} else {
+		fmt.Fprintf(&sb, "http://%v {\n", cfg.serverName())
+	}
+	directive := "handle"
+	if cfg.StripPrefix {
+		directive = "handle_path"
+	}
+	for _, r := range routes {
+		matcher := r.Prefix + "/*"
+		if r.Prefix == "/" {
+			matcher = "/*"
+		}
+		fmt.Fprintf(&sb, "\n\t%v %v {\n", directive, matcher)
+		fmt.Fprintf(&sb, "\t\treverse_proxy %v\n", r.Upstream())
+		sb.WriteString("\t}\n")
+	}
+	sb.WriteString("}\n")
+	if cfg.https() && cfg.RedirectHTTP {
+		fmt.Fprintf(&sb, "\nhttp://%v {\n", cfg.serverName())
+		sb.WriteString("\tredir https://{host}{uri} permanent\n")
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+// TraefikLabels returns the docker labels that configure Traefik to route to
+// the service behind the given route. With HTTPS, the routers serve the
+// certificate of TraefikTLSConfig, which labels cannot configure
+func TraefikLabels(r Route, cfg RouteConfig) map[string]string {
+	name := r.Container
+	labels := map[string]string{
+		"traefik.enable": "true",
+		fmt.Sprintf("traefik.http.routers.%v.rule", name):                      fmt.Sprintf("Host(`%v`) && PathPrefix(`%v`)", cfg.serverName(), r.Prefix),
+		fmt.Sprintf("traefik.http.services.%v.loadbalancer.server.port", name): r.Port,
+	}
+	if cfg.https() {
+		labels[fmt.Sprintf("traefik.http.routers.%v.entrypoints", name)] = "websecure"
+		labels[fmt.Sprintf("traefik.http.routers.%v.tls", name)] = "true"
+		if cfg.RedirectHTTP {
+			labels[fmt.Sprintf("traefik.http.routers.%v-http.rule", name)] = labels[fmt.Sprintf("traefik.http.routers.%v.rule", name)]
+			labels[fmt.Sprintf("traefik.http.routers.%v-http.entrypoints", name)] = "web"
+			labels[fmt.Sprintf("traefik.http.routers.%v-http.middlewares", name)] = "https-redirect"
+			labels["traefik.http.middlewares.https-redirect.redirectscheme.scheme"] = "https"
+			labels["traefik.http.middlewares.https-redirect.redirectscheme.permanent"] = "true"
+		}
+	} else {
+		labels[fmt.Sprintf("traefik.http.routers.%v.entrypoints", name)] = "web"
+	}
+	if cfg.StripPrefix && r.Prefix != "/" {
+		labels[fmt.Sprintf("traefik.http.middlewares.%v-strip.stripprefix.prefixes", name)] = r.Prefix
+		labels[fmt.Sprintf("traefik.http.routers.%v.middlewares", name)] = name + "-strip"
+	}
+	return labels
+}
+
+// TraefikTLSConfig generates the dynamic configuration that makes Traefik
+// serve the certificate of the config by default. It is meant for the file
+// provider of the router, as certificates cannot be set through labels, and
+// is empty without HTTPS
+func TraefikTLSConfig(cfg RouteConfig) string {
+	if !cfg.https() {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("tls:\n")
+	sb.WriteString("  stores:\n")
+	sb.WriteString("    default:\n")
+	sb.WriteString("      defaultCertificate:\n")
+	fmt.Fprintf(&sb, "        certFile: %v\n", cfg.CertFile)
+	fmt.Fprintf(&sb, "        keyFile: %v\n", cfg.KeyFile)
+	return sb.String()
+}
+
+// ApplyTraefikLabels adds the Traefik labels of each route to the matching
+// compose service
+func (cf *ComposeFile) ApplyTraefikLabels(routes []Route, cfg RouteConfig) {
+	for _, r := range routes {
+		svc, ok := cf.Services[r.Container]
+		if !ok {
+			continue
+		}
+		if svc.Labels == nil {
+			svc.Labels = make(map[string]string)
+		}
+		for k, v := range TraefikLabels(r, cfg) {
+			svc.Labels[k] = v
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The schedulers that scheduled tasks can be emitted for
+const (
+	// SchedulerOfelia labels the services for Ofelia, which runs the tasks
+	// inside the running containers with docker exec
+	SchedulerOfelia = "ofelia"
+	// SchedulerCron adds a sidecar per scheduled service that runs the tasks
+	// with supercronic, so the image of the service has to provide it
+	SchedulerCron = "cron"
+)
+
+const (
+	ofeliaContainer = "scheduler"
+	ofeliaImage     = "mcuadros/ofelia:latest"
+	cronSuffix      = "-cron"
+	crontabVariable = "CRONTAB"
+)
+
+// ScheduledTask is a periodic task of a service, found in the "schedule"
+// section of its registry entry
+type ScheduledTask struct {
+	Name string `json:"name"`
+	// Cron is a five field cron expression or one of the descriptors
+	// @yearly, @monthly, @weekly, @daily, @hourly and "@every <duration>"
+	Cron    string `json:"cron"`
+	Command string `json:"command"`
+	// Timeout is a duration such as "10m" after which the task is killed
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// command returns the command of the task, wrapped in timeout(1) when the
+// task has a timeout
+func (st ScheduledTask) command() string {
+	d, err := time.ParseDuration(st.Timeout)
+	if st.Timeout == "" || err != nil {
+		return st.Command
+	}
+	return fmt.Sprintf("timeout %v %v", int(d.Seconds()), st.Command)
+}
+
+// validate checks the task, which ReadFromFile does for every task so that
+// mistakes surface when the registry is loaded
+func (st ScheduledTask) validate() error {
+	if st.Name == "" || st.Command == "" {
+		return fmt.Errorf("a scheduled task needs a name and a command")
+	}
+	if st.Timeout != "" {
+		if d, err := time.ParseDuration(st.Timeout); err != nil || d < time.Second {
+			return fmt.Errorf("the timeout of '%v' is not a duration of at least a second: '%v'", st.Name, st.Timeout)
+		}
+	}
+	if err := validateCron(st.Cron); err != nil {
+		return fmt.Errorf("the schedule of '%v' is invalid: %v", st.Name, err)
+	}
+	return nil
+}
+
+var cronDescriptors = map[string]bool{
+	"@yearly":   true,
+	"@annually": true,
+	"@monthly":  true,
+	"@weekly":   true,
+	"@daily":    true,
+	"@midnight": true,
+	"@hourly":   true,
+}
+
+// cronFields holds the range and names of each field of a cron expression
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{"day of week", 0, 7, []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// validateCron accepts five field cron expressions, with lists, ranges,
+// steps and month and day names, and the descriptors of ScheduledTask.Cron
+func validateCron(spec string) error {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d < time.Second {
+			return fmt.Errorf("'%v' is not a duration of at least a second", spec)
+		}
+		return nil
+	}
+	if strings.HasPrefix(spec, "@") {
+		if !cronDescriptors[spec] {
+			return fmt.Errorf("'%v' is not a known descriptor", spec)
+		}
+		return nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("'%v' has %v fields instead of %v", spec, len(fields), len(cronFields))
+	}
+	for i, field := range fields {
+		f := cronFields[i]
+		value := func(s string) (int, error) {
+			for j, name := range f.names {
+				if strings.EqualFold(s, name) {
+					return j + f.min, nil
+				}
+			}
+			v, err := strconv.Atoi(s)
+			if err != nil || v < f.min || v > f.max {
+				return 0, fmt.Errorf("'%v' is not a valid %v", s, f.name)
+			}
+			return v, nil
+		}
+		for _, part := range strings.Split(field, ",") {
+			rng, step := part, ""
+			if k := strings.Index(part, "/"); k >= 0 {
+				rng, step = part[:k], part[k+1:]
+				if n, err := strconv.Atoi(step); err != nil || n < 1 {
+					return fmt.Errorf("'%v' is not a valid step of the %v", step, f.name)
+				}
+			}
+			if rng == "*" {
+				continue
+			}
+			bounds := strings.SplitN(rng, "-", 2)
+			lo, err := value(bounds[0])
+			if err != nil {
+				return err
+			}
+			if len(bounds) == 2 {
+				hi, err := value(bounds[1])
+				if err != nil {
+					return err
+				}
+				if hi < lo {
+					return fmt.Errorf("'%v' is not a valid range of the %v", rng, f.name)
+				}
+			} else if step != "" {
+				return fmt.Errorf("'%v' steps over a single %v", part, f.name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSchedules checks the scheduled tasks of every service
+func (rf *RegistryFile) validateSchedules() error {
+	for _, svc := range rf.Services {
+		names := make(map[string]bool)
+		for _, st := range svc.Schedule {
+			if err := st.validate(); err != nil {
+				return fmt.Errorf("Could not read the schedule of '%v': %v", svc.serviceName(), err)
+			}
+			if names[st.Name] {
+				return fmt.Errorf("Could not read the schedule of '%v': the task '%v' is defined twice", svc.serviceName(), st.Name)
+			}
+			names[st.Name] = true
+		}
+	}
+	return nil
+}
+
+// ScheduleTransformer emits the scheduled tasks of the services in the
+// compose file for the given scheduler
+type ScheduleTransformer struct {
+	Scheduler string
+}
+
+// Transform implements Transformer
+func (t ScheduleTransformer) Transform(ctx context.Context, cf *ComposeFile, rf *RegistryFile) error {
+	scheduled := make(map[string][]ScheduledTask)
+	for _, svc := range rf.Services {
+		if _, ok := cf.Services[svc.Container]; ok && len(svc.Schedule) > 0 {
+			scheduled[svc.Container] = svc.Schedule
+		}
+	}
+	if len(scheduled) == 0 {
+		return nil
+	}
+
+	switch t.Scheduler {
+	case SchedulerOfelia:
+		return cf.applyOfelia(scheduled)
+	case SchedulerCron:
+		return cf.applyCronSidecars(scheduled)
+	}
+	return fmt.Errorf("Unknown scheduler '%v'", t.Scheduler)
+}
+
+// applyOfelia labels the scheduled services with their tasks and adds the
+// Ofelia service, which reads the labels through the docker socket
+func (cf *ComposeFile) applyOfelia(scheduled map[string][]ScheduledTask) error {
+	if _, ok := cf.Services[ofeliaContainer]; ok {
+		return fmt.Errorf("Could not add the scheduler: a service named '%v' exists", ofeliaContainer)
+	}
+	scheduler := &Service{
+		Image:   ofeliaImage,
+		Command: "daemon --docker",
+		Volumes: []Attribute{"/var/run/docker.sock:/var/run/docker.sock:ro"},
+	}
+	for _, name := range cf.serviceNames() {
+		tasks, ok := scheduled[name]
+		if !ok {
+			continue
+		}
+		svc := cf.Services[name]
+		if svc.Labels == nil {
+			svc.Labels = make(map[string]string)
+		}
+		svc.Labels["ofelia.enabled"] = "true"
+		for _, st := range tasks {
+			job := fmt.Sprintf("ofelia.job-exec.%v-%v", name, st.Name)
+			svc.Labels[job+".schedule"] = ofeliaSchedule(st.Cron)
+			svc.Labels[job+".command"] = escapeInterpolation(st.command())
+		}
+		scheduler.DependsOn = scheduler.DependsOn.And(Attribute(name))
+	}
+	cf.Services[ofeliaContainer] = scheduler
+	return nil
+}
+
+// ofeliaSchedule converts a five field cron expression to the six field
+// form, with seconds, that Ofelia expects
+func ofeliaSchedule(spec string) string {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@") {
+		return spec
+	}
+	return "0 " + spec
+}
+
+// applyCronSidecars adds a sidecar next to every scheduled service that
+// runs its tasks with supercronic. The sidecar shares the image, environment,
+// secrets, volumes and groups of the service, and joins its networks without
+// their addresses and aliases, which must stay unique to the service
+func (cf *ComposeFile) applyCronSidecars(scheduled map[string][]ScheduledTask) error {
+	for _, name := range sortedTaskServices(scheduled) {
+		sidecarName := name + cronSuffix
+		if _, ok := cf.Services[sidecarName]; ok {
+			return fmt.Errorf("Could not add the cron sidecar of '%v': a service named '%v' exists", name, sidecarName)
+		}
+		var crontab strings.Builder
+		for _, st := range scheduled[name] {
+			fmt.Fprintf(&crontab, "%v %v\n", strings.TrimSpace(st.Cron), st.command())
+		}
+
+		svc := cf.Services[name]
+		sidecar := &Service{
+			Image:       svc.Image,
+			Environment: cloneMap(svc.Environment),
+			Secrets:     cloneServiceSecrets(svc.Secrets),
+			Volumes:     cloneAttributeSlice(svc.Volumes),
+			Groups:      cloneStrings(svc.Groups),
+		}
+		for _, n := range svc.Networks {
+			sidecar.Networks = append(sidecar.Networks, ServiceNetwork{Name: n.Name})
+		}
+		if sidecar.Environment == nil {
+			sidecar.Environment = make(map[string]interface{})
+		}
+		sidecar.Environment[crontabVariable] = escapeInterpolation(crontab.String())
+		sidecar.Command = fmt.Sprintf(`sh -c 'printf "%%s" "$$%v" > /tmp/crontab && exec supercronic /tmp/crontab'`, crontabVariable)
+		sidecar.DependsOn = Attributes{Attribute(name)}
+		cf.Services[sidecarName] = sidecar
+	}
+	return nil
+}
+
+// escapeInterpolation keeps docker compose from substituting variables in a
+// value that is meant for a shell
+func escapeInterpolation(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+func sortedTaskServices(scheduled map[string][]ScheduledTask) []string {
+	names := make(map[string]bool, len(scheduled))
+	for name := range scheduled {
+		names[name] = true
+	}
+	return sortedKeys(names)
+}
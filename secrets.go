@@ -0,0 +1,183 @@
+package containerutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SecretDefinition is a top-level secret that is declared in the "secrets"
+// section of service-registry.json. A secret is either read from a file on
+// the host or is external, in which case it has been created beforehand
+// with "docker secret create"
+type SecretDefinition struct {
+	File     string `json:"file,omitempty"`
+	External bool   `json:"external,omitempty"`
+	// Name is the name of an external secret, when it differs from the key
+	Name string `json:"name,omitempty"`
+}
+
+// compose returns the top-level compose representation of the secret
+func (sd SecretDefinition) compose() map[string]interface{} {
+	if sd.External {
+		m := map[string]interface{}{"external": true}
+		if sd.Name != "" {
+			m["name"] = sd.Name
+		}
+		return m
+	}
+	return map[string]interface{}{"file": sd.File}
+}
+
+// ServiceSecret is a reference from a service to a secret. Only Source is
+// required, in which case the short syntax is used in compose files and the
+// secret is mounted at /run/secrets/<source>
+type ServiceSecret struct {
+	Source string `json:"source" yaml:"source"`
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+	UID    string `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID    string `json:"gid,omitempty" yaml:"gid,omitempty"`
+	// Mode is the octal file mode, e.g. "0440"
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+func (s ServiceSecret) isShort() bool {
+	return s.Target == "" && s.UID == "" && s.GID == "" && s.Mode == ""
+}
+
+// MarshalYAML writes the short syntax when possible, and the long syntax
+// otherwise. The mode is written as an octal literal
+func (s ServiceSecret) MarshalYAML() (interface{}, error) {
+	if s.isShort() {
+		return s.Source, nil
+	}
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	add := func(key, value, tag string) {
+		if value == "" {
+			return
+		}
+		n.Content = append(n.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value})
+	}
+	add("source", s.Source, "!!str")
+	add("target", s.Target, "!!str")
+	add("uid", s.UID, "!!str")
+	add("gid", s.GID, "!!str")
+	add("mode", s.Mode, "!!int")
+	return n, nil
+}
+
+// UnmarshalYAML accepts both the short and the long syntax
+func (s *ServiceSecret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = ServiceSecret{Source: value.Value}
+		return nil
+	}
+	type plain ServiceSecret
+	return value.Decode((*plain)(s))
+}
+
+// UnmarshalJSON accepts both a plain secret name and an object
+func (s *ServiceSecret) UnmarshalJSON(b []byte) error {
+	var source string
+	if err := json.Unmarshal(b, &source); err == nil {
+		*s = ServiceSecret{Source: source}
+		return nil
+	}
+	type plain ServiceSecret
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+// ServiceSecrets is a slice of ServiceSecret - has methods on it
+type ServiceSecrets []ServiceSecret
+
+// Contains checks if a secret with the given source is referenced
+func (ss ServiceSecrets) Contains(source string) bool {
+	for _, s := range ss {
+		if s.Source == source {
+			return true
+		}
+	}
+	return false
+}
+
+// And creates a new slice with the given secrets appended
+func (ss ServiceSecrets) And(s ...ServiceSecret) ServiceSecrets {
+	return append(ss, s...)
+}
+
+// applySecrets declares the registry secrets that are referenced by the
+// services of the compose file
+func (cf *ComposeFile) applySecrets(definitions map[string]SecretDefinition) {
+	for _, svc := range cf.Services {
+		for _, ref := range svc.Secrets {
+			def, ok := definitions[ref.Source]
+			if !ok {
+				continue
+			}
+			if cf.Secrets == nil {
+				cf.Secrets = make(map[string]map[string]interface{})
+			}
+			cf.Secrets[ref.Source] = def.compose()
+		}
+	}
+}
+
+var (
+	secretKeyPattern   = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|PRIVATE_?KEY|CREDENTIAL)`)
+	secretValuePattern = regexp.MustCompile(`^-----BEGIN |^eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.|://[^/\s:@]+:[^/\s@]+@`)
+)
+
+// looksLikeSecret reports whether an environment variable appears to hold a
+// credential in plain text. References to files and variable interpolation
+// are fine
+func looksLikeSecret(key string, value interface{}) bool {
+	v := strings.TrimSpace(fmt.Sprintf("%v", value))
+	if value == nil || v == "" || strings.HasPrefix(v, "/run/secrets/") || strings.HasPrefix(v, "${") {
+		return false
+	}
+	if secretValuePattern.MatchString(v) {
+		return true
+	}
+	return secretKeyPattern.MatchString(key) && !strings.HasSuffix(strings.ToUpper(key), "_FILE")
+}
+
+// LintSecrets reports secrets that are referenced by a service but not
+// declared at the top level, and environment values that look like
+// passwords or tokens and should be provided as secrets instead
+func (cf *ComposeFile) LintSecrets() []Warning {
+	var warnings []Warning
+	for _, name := range cf.serviceNames() {
+		svc := cf.Services[name]
+		for _, ref := range svc.Secrets {
+			if _, ok := cf.Secrets[ref.Source]; !ok {
+				warnings = append(warnings, Warning{
+					Service: name,
+					Field:   "secrets",
+					Message: fmt.Sprintf("the secret '%v' is not declared", ref.Source),
+				})
+			}
+		}
+
+		keys := make([]string, 0, len(svc.Environment))
+		for k := range svc.Environment {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if looksLikeSecret(k, svc.Environment[k]) {
+				warnings = append(warnings, Warning{
+					Service: name,
+					Field:   "environment." + k,
+					Message: "looks like a password or token, provide it as a secret instead",
+				})
+			}
+		}
+	}
+	return warnings
+}
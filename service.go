@@ -1,7 +1,26 @@
 package containerutils
 
+import "context"
+
 var _file = RegistryFile{}
 
+// LoadServiceRegistry reads the service-registry.json that the Construct*
+// functions work from. When an environment is given, its overrides are
+// deep-merged onto the registry and the returned report shows which values
+// came from which layer
+func LoadServiceRegistry(filename string, environment string) (OverlayReport, error) {
+	rf := RegistryFile{}
+	if err := rf.ReadFromFile(filename); err != nil {
+		return OverlayReport{}, err
+	}
+	report, err := rf.WithEnvironment(filename, environment)
+	if err != nil {
+		return report, err
+	}
+	_file = rf
+	return report, nil
+}
+
 // ConstructServiceRegistry returns the a pretty-printed byte representation
 // of the service-registry.json
 func ConstructServiceRegistry() ([]byte, error) {
@@ -9,19 +28,119 @@ func ConstructServiceRegistry() ([]byte, error) {
 }
 
 // ConstructDeveloperCompose returns all the services that
-// are containerized
-func ConstructDeveloperCompose() ComposeFile {
-	return _file.Services.ToDockerCompose("", developerCompose, 0)
+// are containerized. Deposed services are left out
+func ConstructDeveloperCompose() (ComposeFile, error) {
+	return _file.ToDockerCompose("", DeveloperMode, 0)
 }
 
 // ConstructOrchestratorCompose returns a compose file for running the test orchestrator
 // This means that the only exposed port is Router
-func ConstructOrchestratorCompose(routerPort int) ComposeFile {
-	return _file.Services.ToDockerCompose("", orchestratorCompose, 0)
+func ConstructOrchestratorCompose(routerPort int) (ComposeFile, error) {
+	return _file.ToDockerCompose("", OrchestratorMode, routerPort)
 }
 
 // ConstructProductionCompose returns a compose file for running the test orchestrator
 // This means that the only exposed port is Router
-func ConstructProductionCompose(tagName string, routerPort int) ComposeFile {
-	return _file.Services.ToDockerCompose(tagName, productionCompose, routerPort)
+func ConstructProductionCompose(tagName string, routerPort int) (ComposeFile, error) {
+	return _file.ToDockerCompose(tagName, ProductionMode, routerPort)
+}
+
+// ConstructCompose returns a compose file for the given mode that only holds
+// the services selected by the config and their dependencies, along with an
+// explanation of why each service was included
+func ConstructCompose(mode Mode, cfg ComposeServiceConfig) (ComposeFile, []Inclusion, error) {
+	return _file.ConstructCompose(mode, cfg)
+}
+
+// ConstructProfileCompose returns a compose file for the given mode that
+// only holds the services that docker compose would start with the given
+// profiles enabled
+func ConstructProfileCompose(mode Mode, profiles ...string) (ComposeFile, error) {
+	cf, err := _file.Generate(context.Background(), GenerateConfig{Mode: mode})
+	if err != nil {
+		return cf, err
+	}
+	return cf.FilterByProfile(profiles...)
+}
+
+// ConstructDeveloperStack returns the developer compose file with its host
+// ports moved by the allocator, so that it can run next to other stacks, and
+// the port map that shows where each service landed
+func ConstructDeveloperStack(pa PortAllocator) (ComposeFile, PortMap, error) {
+	cf, err := ConstructDeveloperCompose()
+	if err != nil {
+		return ComposeFile{}, nil, err
+	}
+	pm, err := pa.Allocate(&cf)
+	if err != nil {
+		return ComposeFile{}, nil, err
+	}
+	return cf, pm, nil
+}
+
+// ConstructOrchestratorStack returns an orchestrator compose file that is
+// namespaced under a unique project name for the given test, along with the
+// ports it was given and the descriptor to tear it down with
+func ConstructOrchestratorStack(testName string) (Stack, error) {
+	return _file.Stack(StackConfig{Name: testName})
+}
+
+// ConstructHybridCompose returns the developer compose file without the
+// given services, which run on the host instead, along with the routes that
+// the router should use to reach them
+func ConstructHybridCompose(local ...string) (ComposeFile, []Route, error) {
+	mode := HybridMode(local...)
+	cf, err := _file.Generate(context.Background(), GenerateConfig{Mode: mode})
+	if err != nil {
+		return cf, nil, err
+	}
+	return cf, _file.RoutesForMode(mode), nil
+}
+
+// ConstructDebugOverlay returns the compose overlay that runs the given
+// services under delve, see RegistryFile.DebugOverlay
+func ConstructDebugOverlay(cfg DebugConfig) (ComposeFile, error) {
+	return _file.DebugOverlay(cfg)
+}
+
+// ConstructPinnedProductionCompose returns the production compose file with
+// every image pinned to the digest recorded in the given lock file. It fails
+// when an image lacks an entry in the lock
+func ConstructPinnedProductionCompose(tagName string, routerPort int, lockFile string) (ComposeFile, error) {
+	lock, err := ReadImageLock(lockFile)
+	if err != nil {
+		return ComposeFile{}, err
+	}
+	cf, err := ConstructProductionCompose(tagName, routerPort)
+	if err != nil {
+		return ComposeFile{}, err
+	}
+	if err := cf.PinImages(lock); err != nil {
+		return ComposeFile{}, err
+	}
+	return cf, nil
+}
+
+// ConstructModeCompose returns a compose file for the named mode, which is
+// either declared in the registry or registered with RegisterMode, running
+// the transformers that the mode lists
+func ConstructModeCompose(mode string, tagName string, routerPort int) (ComposeFile, error) {
+	m, err := _file.Mode(mode)
+	if err != nil {
+		return ComposeFile{}, err
+	}
+	return _file.Generate(context.Background(), GenerateConfig{Tag: tagName, Mode: m, RouterPort: routerPort})
+}
+
+// RegenerateCompose merges a compose file produced by one of the Construct*
+// functions with the existing compose file of a live install, keeping its
+// unmanaged services and reporting the deposed services that were removed
+func RegenerateCompose(existing *ComposeFile, generated ComposeFile) (ComposeFile, MigrationReport) {
+	return _file.Regenerate(existing, generated)
+}
+
+// ConstructPGConnectionBudget calculates the Postgres connections that the
+// registry services need, along with the dbpool configuration that fits them
+func ConstructPGConnectionBudget(cfg PGBudgetConfig) (PGBudgetReport, error) {
+	return _file.PGConnectionBudget(cfg)
 }
@@ -0,0 +1,139 @@
+package containerutils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// StackConfig describes an isolated stack, typically one per integration test
+type StackConfig struct {
+	// Name identifies the stack, e.g. the name of the test. A random suffix
+	// is added, so the same name can be used by concurrent runs
+	Name string
+	// Mode defaults to OrchestratorMode
+	Mode *Mode
+	Tag  string
+}
+
+// Stack is a compose file that is namespaced so that it can run next to
+// other stacks of the same registry on one host
+type Stack struct {
+	// Project is the compose project name, which is also set as the name of
+	// the compose file. Only the Compose Spec knows the top-level name, so
+	// the file is written without a version and needs Compose v2. Teardown
+	// passes the project with -p as well
+	Project  string
+	Compose  ComposeFile
+	Ports    PortMap
+	Teardown Teardown
+}
+
+// Teardown lists everything that a stack creates on the docker host, so that
+// it can be removed once the test is done, even when the test process died
+type Teardown struct {
+	Project    string   `json:"project"`
+	Containers []string `json:"containers"`
+	Networks   []string `json:"networks,omitempty"`
+	Volumes    []string `json:"volumes,omitempty"`
+}
+
+// Command returns the docker command that removes the stack that was written
+// to the given compose file
+func (t Teardown) Command(composeFile string) []string {
+	return []string{"docker", "compose", "-p", t.Project, "-f", composeFile, "down", "--volumes", "--remove-orphans"}
+}
+
+// Write writes the teardown descriptor as JSON
+func (t Teardown) Write(filename string) error {
+	b, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Could not marshal JSON: %v", err)
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// Stack generates a compose file for the config and namespaces it with a
+// unique project name: containers are named after the project, networks and
+// named volumes are scoped to it and every published port is an ephemeral
+// host port. Bind mounts are shared with other stacks
+func (rf *RegistryFile) Stack(cfg StackConfig) (Stack, error) {
+	mode := OrchestratorMode
+	if cfg.Mode != nil {
+		mode = *cfg.Mode
+	}
+	project, err := stackProject(cfg.Name)
+	if err != nil {
+		return Stack{}, err
+	}
+	cf, err := rf.Generate(context.Background(), GenerateConfig{Tag: cfg.Tag, Mode: mode})
+	if err != nil {
+		return Stack{}, err
+	}
+	cf.Name = project
+
+	pm, err := PortAllocator{Ephemeral: true}.Allocate(&cf)
+	if err != nil {
+		return Stack{}, err
+	}
+
+	td := Teardown{Project: project, Networks: []string{project + "_" + defaultNetwork}}
+	volumes := make(map[string]bool)
+	for _, name := range cf.serviceNames() {
+		svc := cf.Services[name]
+		svc.ContainerName = project + "-" + name
+		td.Containers = append(td.Containers, svc.ContainerName)
+		for _, v := range svc.Volumes {
+			if source := namedVolume(v); source != "" {
+				volumes[project+"_"+source] = true
+			}
+		}
+	}
+	td.Volumes = sortedKeys(volumes)
+	for _, name := range sortedTopLevelNames(cf.Networks) {
+		n := cf.Networks[name]
+		if external, _ := n["external"].(bool); external {
+			continue
+		}
+		n["name"] = project + "_" + name
+		td.Networks = append(td.Networks, project+"_"+name)
+	}
+	return Stack{Project: project, Compose: cf, Ports: pm, Teardown: td}, nil
+}
+
+// stackProject turns a test name into a unique compose project name, which
+// may only hold lowercase letters, digits, dashes and underscores
+func stackProject(name string) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("Could not name the stack '%v': %v", name, err)
+	}
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('-')
+		}
+	}
+	base := strings.Trim(sb.String(), "-_")
+	if base == "" {
+		base = "stack"
+	}
+	return base + "-" + hex.EncodeToString(suffix), nil
+}
+
+// namedVolume returns the source of a "source:target" volume when it is a
+// named volume rather than a bind mount
+func namedVolume(v Attribute) string {
+	parts := strings.SplitN(v.String(), ":", 2)
+	if len(parts) < 2 || strings.ContainsAny(parts[0], "/\\~.$") {
+		return ""
+	}
+	return parts[0]
+}
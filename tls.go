@@ -0,0 +1,204 @@
+package containerutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultHTTPSPort       = 443
+	routerCertSecret       = "router_tls_cert"
+	routerKeySecret        = "router_tls_key"
+	selfSignedCertFilename = "router.crt"
+	selfSignedKeyFilename  = "router.key"
+	selfSignedValidFor     = 365 * 24 * time.Hour
+)
+
+// TLSConfig describes how the router terminates HTTPS. It is read from the
+// options map of ComposeFile.Write with the following keys:
+//   - "httpsport": the host port that the router's port 443 is bound to
+//   - "httpsbind": the host IP that the HTTPS port is bound to
+//   - "tlscert" and "tlskey": the certificate and key files on the host
+//   - "selfsigned": generates a self-signed certificate for developer installs
+//     when the certificate files do not exist yet
+//   - "tlshosts": the []string of host names and IPs for the self-signed certificate
+//   - "httpsredirect": redirects plain HTTP requests to HTTPS
+type TLSConfig struct {
+	HostPort     int
+	BindIP       string
+	CertFile     string
+	KeyFile      string
+	SelfSigned   bool
+	Hosts        []string
+	RedirectHTTP bool
+}
+
+func parseTLSOptions(options map[string]interface{}) TLSConfig {
+	tc := TLSConfig{HostPort: defaultHTTPSPort}
+	if p, ok := intOption(options["httpsport"]); ok {
+		tc.HostPort = p
+	}
+	tc.BindIP, _ = options["httpsbind"].(string)
+	tc.CertFile, _ = options["tlscert"].(string)
+	tc.KeyFile, _ = options["tlskey"].(string)
+	tc.SelfSigned, _ = options["selfsigned"].(bool)
+	tc.Hosts, _ = options["tlshosts"].([]string)
+	tc.RedirectHTTP, _ = options["httpsredirect"].(bool)
+	return tc
+}
+
+// portMapping returns the router port entry for HTTPS
+func (tc TLSConfig) portMapping() string {
+	if tc.BindIP == "" {
+		return fmt.Sprintf("%v:443", tc.HostPort)
+	}
+	return fmt.Sprintf("%v:%v:443", tc.BindIP, tc.HostPort)
+}
+
+// hasCertificate reports whether a certificate will be mounted into the router
+func (tc TLSConfig) hasCertificate() bool {
+	return tc.SelfSigned || (tc.CertFile != "" && tc.KeyFile != "")
+}
+
+// certificateFiles returns the files of the certificate and key secrets,
+// generating a self-signed pair when requested. Compose resolves the file of
+// a secret relative to the compose file, so a generated pair is written next
+// to it and referred to by its base name, and relative "tlscert" and
+// "tlskey" paths are resolved against its directory as well
+func (tc TLSConfig) certificateFiles(filename string) (certFile, keyFile string, err error) {
+	certFile, keyFile = tc.CertFile, tc.KeyFile
+	if !tc.SelfSigned {
+		return certFile, keyFile, nil
+	}
+	dir := filepath.Dir(filename)
+	if certFile == "" {
+		certFile = "./" + selfSignedCertFilename
+	}
+	if keyFile == "" {
+		keyFile = "./" + selfSignedKeyFilename
+	}
+	certPath, keyPath := certFile, keyFile
+	if !filepath.IsAbs(certPath) {
+		certPath = filepath.Join(dir, certPath)
+	}
+	if !filepath.IsAbs(keyPath) {
+		keyPath = filepath.Join(dir, keyPath)
+	}
+	if !fileExists(certPath) || !fileExists(keyPath) {
+		if err := WriteSelfSignedCertificate(certPath, keyPath, tc.Hosts); err != nil {
+			return "", "", err
+		}
+	}
+	return certFile, keyFile, nil
+}
+
+// applyTLS mounts the certificate and key into the router as compose secrets,
+// generating a self-signed pair next to the compose file when requested
+func (cf *ComposeFile) applyTLS(tc TLSConfig, filename string) error {
+	router, ok := cf.Services[routerService]
+	if !ok || !tc.hasCertificate() {
+		return nil
+	}
+	certFile, keyFile, err := tc.certificateFiles(filename)
+	if err != nil {
+		return err
+	}
+
+	if cf.Secrets == nil {
+		cf.Secrets = make(map[string]map[string]interface{})
+	}
+	cf.Secrets[routerCertSecret] = map[string]interface{}{"file": certFile}
+	cf.Secrets[routerKeySecret] = map[string]interface{}{"file": keyFile}
+	for _, secret := range []string{routerCertSecret, routerKeySecret} {
+		if !router.Secrets.Contains(secret) {
+			router.Secrets = router.Secrets.And(ServiceSecret{Source: secret})
+		}
+	}
+	return nil
+}
+
+// RouterCertificatePaths returns the paths inside the router container at
+// which the certificate and key secrets are mounted
+func RouterCertificatePaths() (certFile, keyFile string) {
+	return "/run/secrets/" + routerCertSecret, "/run/secrets/" + routerKeySecret
+}
+
+// GenerateSelfSignedCertificate creates a PEM encoded, self-signed server
+// certificate and its ECDSA key for the given host names and IP addresses.
+// It is meant for developer installs only. "localhost" and 127.0.0.1 are
+// used when no hosts are given
+func GenerateSelfSignedCertificate(hosts []string) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not generate serial number: %v", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"containerutils self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not marshal key: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// WriteSelfSignedCertificate generates a self-signed certificate and writes
+// it, along with its key, to the given files
+func WriteSelfSignedCertificate(certFile, keyFile string, hosts []string) error {
+	certPEM, keyPEM, err := GenerateSelfSignedCertificate(hosts)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("Could not write '%v': %v", certFile, err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("Could not write '%v': %v", keyFile, err)
+	}
+	return nil
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
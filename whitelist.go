@@ -0,0 +1,157 @@
+package containerutils
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Inclusion explains why a service is part of a compose file that was
+// constructed from a ComposeServiceConfig
+type Inclusion struct {
+	Service string
+	Reason  string
+	// RequiredBy is set for services that were only included because
+	// another service depends on them
+	RequiredBy string
+}
+
+func (i Inclusion) String() string {
+	return fmt.Sprintf("%v: %v", i.Service, i.Reason)
+}
+
+// ConstructCompose returns a compose file for the given mode that holds the
+// whitelisted services and those in the selected profiles, along with the
+// transitive closure of their dependencies. When neither a whitelist nor
+// profiles are given, every service of the mode is included. The profiles of
+// a selection are cleared, as FilterByProfile does, so that a plain "docker
+// compose up" starts all of it. The returned inclusions explain why each
+// service is present
+func (rf *RegistryFile) ConstructCompose(mode Mode, cfg ComposeServiceConfig) (ComposeFile, []Inclusion, error) {
+	template, err := rf.Generate(context.Background(), GenerateConfig{Mode: mode})
+	if err != nil {
+		return template, nil, err
+	}
+	if cfg.WhiteList == nil && cfg.Profiles == nil {
+		inclusions := make([]Inclusion, 0, len(template.Services))
+		for _, name := range template.serviceNames() {
+			inclusions = append(inclusions, Inclusion{Service: name, Reason: "no whitelist was given"})
+		}
+		return template, inclusions, nil
+	}
+
+	out := ComposeFile{
+		Version:  template.Version,
+		Name:     template.Name,
+		Services: make(map[string]*Service),
+	}
+	reasons := make(map[string]Inclusion)
+	names := template.serviceNames()
+
+	if cfg.WhiteList != nil {
+		for _, pattern := range *cfg.WhiteList {
+			matched := false
+			for _, name := range names {
+				ok, err := path.Match(pattern, name)
+				if err != nil {
+					return ComposeFile{}, nil, fmt.Errorf("Invalid whitelist pattern '%v': %v", pattern, err)
+				}
+				if !ok {
+					continue
+				}
+				matched = true
+				if _, seen := reasons[name]; seen {
+					continue
+				}
+				out.Services[name] = template.Services[name]
+				reason := "whitelisted"
+				if pattern != name {
+					reason = fmt.Sprintf("matches whitelist pattern '%v'", pattern)
+				}
+				reasons[name] = Inclusion{Service: name, Reason: reason}
+			}
+			if !matched {
+				return ComposeFile{}, nil, fmt.Errorf("'%v' does not match any service", pattern)
+			}
+		}
+	}
+
+	if cfg.Profiles != nil {
+		for _, profile := range *cfg.Profiles {
+			for _, name := range names {
+				if _, seen := reasons[name]; seen || !template.Services[name].Profiles.Contains(profile) {
+					continue
+				}
+				out.Services[name] = template.Services[name]
+				reasons[name] = Inclusion{Service: name, Reason: fmt.Sprintf("in profile '%v'", profile)}
+			}
+		}
+	}
+
+	deps := func(service string) []string {
+		return rf.dependenciesOf(service, &template)
+	}
+	_, err = resolveDependencies(&out, &template, deps, func(service, requiredBy string) {
+		reasons[service] = Inclusion{
+			Service:    service,
+			Reason:     fmt.Sprintf("dependency of '%v'", requiredBy),
+			RequiredBy: requiredBy,
+		}
+	})
+	if err != nil {
+		return ComposeFile{}, nil, err
+	}
+	// Dependencies that the mode leaves out cannot be pulled in, so they are
+	// dropped as they are for any other service that is not part of the file
+	out.EnsureDependencies()
+	for name, svc := range out.Services {
+		_svc := *svc
+		_svc.Profiles = nil
+		out.Services[name] = &_svc
+	}
+	out.adoptReferences(&template)
+
+	inclusions := make([]Inclusion, 0, len(reasons))
+	for _, name := range out.serviceNames() {
+		inclusions = append(inclusions, reasons[name])
+	}
+	return out, inclusions, nil
+}
+
+// dependenciesOf returns the containers of the compose file that a container
+// depends on, both through depends_on and the "dependencies" of its registry
+// entry. Dependencies that are not part of the compose file, e.g. because
+// the mode excludes them, are skipped
+func (rf *RegistryFile) dependenciesOf(container string, cf *ComposeFile) []string {
+	var deps []string
+	for _, dep := range cf.dependsOn(container) {
+		if cf.HasService(dep) {
+			deps = append(deps, dep)
+		}
+	}
+	i := rf.serviceIndex(container)
+	if i < 0 {
+		return deps
+	}
+	for _, dep := range rf.Services[i].Dependencies {
+		j := rf.serviceIndex(dep)
+		if j < 0 {
+			continue
+		}
+		if c := rf.Services[j].Container; cf.HasService(c) && !containsString(deps, c) {
+			deps = append(deps, c)
+		}
+	}
+	return deps
+}
+
+// serviceNames returns the names of the services in alphabetical order
+func (cf *ComposeFile) serviceNames() []string {
+	names := make([]string, 0, len(cf.Services))
+	for name := range cf.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}